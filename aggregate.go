@@ -0,0 +1,370 @@
+package kvdb
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"strings"
+)
+
+/*
+A query with aggregates, GROUP BY or HAVING folds the rows the WHERE clause
+selects into groups by the GROUP BY columns, one group in all without them.
+A group comes out as a group row: the GROUP BY columns followed by the
+results of the aggregates. The output columns and HAVING are rewritten to
+read the group row, so they may only use the GROUP BY columns outside of
+the aggregates.
+
+The cells have no NULL, so SUM, AVG, MIN and MAX of no values give a cell
+without a type, which IS NULL tests for. AVG rounds toward zero.
+*/
+
+// ExprCall is a call of an aggregate function, arg is nil for COUNT(*).
+type ExprCall struct {
+	name string
+	arg  Expr
+}
+
+// exprAgg is an aggregate bound by bindExpr.
+type exprAgg struct {
+	name string
+	arg  Expr
+}
+
+var aggregates = []string{"COUNT", "SUM", "AVG", "MIN", "MAX"}
+
+// parseCall parses the arguments of a function call after its name.
+func (p *Parser) parseCall(name string) (Expr, error) {
+	call := &ExprCall{name: strings.ToUpper(name)}
+	if !slices.Contains(aggregates, call.name) {
+		return nil, errors.New("unknown function " + name)
+	}
+	if !p.tryPunctuation("*") {
+		var err error
+		if call.arg, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	if !p.tryPunctuation(")") {
+		return nil, errors.New("expect )")
+	}
+	return call, nil
+}
+
+func bindCall(schema *Schema, e *ExprCall) (Expr, CellType, error) {
+	if e.arg == nil {
+		if e.name != "COUNT" {
+			return nil, 0, errors.New(e.name + "(*) is not allowed")
+		}
+		return &exprAgg{name: e.name}, TypeI64, nil
+	}
+	arg, typ, err := bindExpr(schema, e.arg)
+	if err != nil {
+		return nil, 0, err
+	}
+	if hasAggregate(arg) {
+		return nil, 0, errors.New("aggregates cannot be nested")
+	}
+	switch e.name {
+	case "COUNT":
+		typ = TypeI64
+	case "SUM", "AVG":
+		if typ != TypeI64 {
+			return nil, 0, errors.New(e.name + " expects integers")
+		}
+	}
+	return &exprAgg{name: e.name, arg: arg}, typ, nil
+}
+
+// rewriteExpr rebuilds a bound expression with fn applied to its columns,
+// constants and aggregates.
+func rewriteExpr(expr Expr, fn func(Expr) (Expr, error)) (Expr, error) {
+	var err error
+	switch e := expr.(type) {
+	case *ExprNot:
+		out := &ExprNot{}
+		out.expr, err = rewriteExpr(e.expr, fn)
+		return out, err
+	case *ExprBinary:
+		out := &ExprBinary{op: e.op}
+		if out.left, err = rewriteExpr(e.left, fn); err != nil {
+			return nil, err
+		}
+		out.right, err = rewriteExpr(e.right, fn)
+		return out, err
+	case *ExprIn:
+		out := &ExprIn{}
+		if out.expr, err = rewriteExpr(e.expr, fn); err != nil {
+			return nil, err
+		}
+		for _, item := range e.list {
+			if item, err = rewriteExpr(item, fn); err != nil {
+				return nil, err
+			}
+			out.list = append(out.list, item)
+		}
+		return out, nil
+	case *ExprLike:
+		out := &ExprLike{}
+		if out.expr, err = rewriteExpr(e.expr, fn); err != nil {
+			return nil, err
+		}
+		out.pattern, err = rewriteExpr(e.pattern, fn)
+		return out, err
+	case *ExprIsNull:
+		out := &ExprIsNull{}
+		out.expr, err = rewriteExpr(e.expr, fn)
+		return out, err
+	default:
+		return fn(expr)
+	}
+}
+
+func hasAggregate(expr Expr) (found bool) {
+	rewriteExpr(expr, func(e Expr) (Expr, error) {
+		_, ok := e.(*exprAgg)
+		found = found || ok
+		return e, nil
+	})
+	return found
+}
+
+type aggPlan struct {
+	plan     *queryPlan // reads the rows
+	group    []int      // the GROUP BY columns
+	aggs     []*exprAgg
+	having   Expr      // over the group rows
+	exprs    []Expr    // the output columns over the group rows
+	sort     []sortCol // over the output rows
+	distinct bool
+	limit    int64 // -1 without LIMIT
+	offset   int64
+	// MIN and MAX of the first primary key column only need the first and
+	// the last row
+	ends bool
+}
+
+// isAggregate reports whether the query folds the rows into groups.
+func isAggregate(stmt *StmtSelect, exprs []Expr) bool {
+	return len(stmt.group) > 0 || stmt.having != nil || slices.ContainsFunc(exprs, hasAggregate)
+}
+
+// planAggregate plans a query with aggregates over the output columns
+// exprs, named names.
+func planAggregate(schema *Schema, stmt *StmtSelect, exprs []Expr, names []string) (*aggPlan, error) {
+	conjs, err := bindWhere(schema, stmt.where)
+	if err != nil {
+		return nil, err
+	}
+	ap := &aggPlan{distinct: stmt.distinct, limit: -1, offset: stmt.offset}
+	if stmt.hasLimit {
+		ap.limit = stmt.limit
+	}
+	if ap.group, err = lookupColumns(schema.Cols, stmt.group); err != nil {
+		return nil, err
+	}
+
+	// point the columns and the aggregates to the group row
+	toGroup := func(expr Expr) (Expr, error) {
+		switch e := expr.(type) {
+		case *exprCol:
+			i := slices.Index(ap.group, e.col)
+			if i < 0 {
+				return nil, errors.New("column " + e.name + " must be in GROUP BY or an aggregate")
+			}
+			return &exprCol{col: i, name: e.name}, nil
+		case *exprAgg:
+			name := formatExpr(e)
+			i := slices.IndexFunc(ap.aggs, func(a *exprAgg) bool { return formatExpr(a) == name })
+			if i < 0 {
+				i = len(ap.aggs)
+				ap.aggs = append(ap.aggs, e)
+			}
+			return &exprCol{col: len(ap.group) + i, name: name}, nil
+		default:
+			return expr, nil
+		}
+	}
+	for _, expr := range exprs {
+		if expr, err = rewriteExpr(expr, toGroup); err != nil {
+			return nil, err
+		}
+		ap.exprs = append(ap.exprs, expr)
+	}
+	if stmt.having != nil {
+		having, typ, err := bindExpr(schema, stmt.having)
+		if err != nil {
+			return nil, err
+		}
+		if typ != TypeI64 {
+			return nil, errors.New("HAVING expects a truth value")
+		}
+		if ap.having, err = rewriteExpr(having, toGroup); err != nil {
+			return nil, err
+		}
+	}
+
+	// ORDER BY names the output columns
+	for _, o := range stmt.order {
+		i := outputColumn(o.column, exprs, names)
+		if i < 0 {
+			return nil, errors.New("ORDER BY " + o.column + " is not an output name")
+		}
+		ap.sort = append(ap.sort, sortCol{col: i, desc: o.desc})
+	}
+
+	ap.ends = len(ap.group) == 0 && len(ap.aggs) > 0 && !slices.ContainsFunc(ap.aggs, func(a *exprAgg) bool {
+		col, ok := a.arg.(*exprCol)
+		return (a.name != "MIN" && a.name != "MAX") || !ok || col.col != schema.PKey[0]
+	})
+	// the ends need the rows in primary key order
+	ap.plan = planQuery(schema, conjs, !ap.ends)
+	ap.plan.limit = -1
+	return ap, nil
+}
+
+// aggState accumulates an aggregate over the values of a group.
+type aggState struct {
+	count int64
+	sum   int64
+	val   Cell // MIN and MAX
+}
+
+func (s *aggState) add(agg *exprAgg, row Row) {
+	if agg.arg == nil {
+		s.count++
+		return
+	}
+	val := evalExpr(agg.arg, row)
+	if val.Type == 0 {
+		return
+	}
+	s.count++
+	s.sum += val.I64
+	if s.count == 1 || (agg.name == "MIN" && val.Compare(&s.val) < 0) ||
+		(agg.name == "MAX" && val.Compare(&s.val) > 0) {
+		s.val = val
+	}
+}
+
+func (s *aggState) result(agg *exprAgg) Cell {
+	if agg.name == "COUNT" {
+		return Cell{Type: TypeI64, I64: s.count}
+	}
+	if s.count == 0 {
+		return Cell{}
+	}
+	switch agg.name {
+	case "SUM":
+		return Cell{Type: TypeI64, I64: s.sum}
+	case "AVG":
+		return Cell{Type: TypeI64, I64: s.sum / s.count}
+	default:
+		return s.val
+	}
+}
+
+type aggGroup struct {
+	key    string // the encoded GROUP BY columns
+	row    Row    // the GROUP BY columns
+	states []aggState
+}
+
+// execAggregate calls fn with the output rows of the query.
+func (tx *Tx) execAggregate(schema *Schema, ap *aggPlan, fn func(Row) error) error {
+	groups := map[string]*aggGroup{}
+	add := func(row Row) error {
+		key := []byte{}
+		for _, col := range ap.group {
+			key = row[col].EncodeKey(key)
+		}
+		g := groups[string(key)]
+		if g == nil {
+			g = &aggGroup{key: string(key), row: subsetRow(row, ap.group), states: make([]aggState, len(ap.aggs))}
+			groups[g.key] = g
+		}
+		for i, agg := range ap.aggs {
+			g.states[i].add(agg, row)
+		}
+		return nil
+	}
+	if ap.ends {
+		ap.plan.limit = 1
+		defer func() { ap.plan.limit = -1 }()
+		for _, reverse := range []bool{false, true} {
+			ap.plan.scan.Reverse = reverse
+			if err := tx.execQuery(schema, ap.plan, add); err != nil {
+				return err
+			}
+		}
+		ap.plan.scan.Reverse = false
+	} else if err := tx.execPlan(schema, ap.plan, add); err != nil {
+		return err
+	}
+	if len(ap.group) == 0 && len(groups) == 0 {
+		groups[""] = &aggGroup{states: make([]aggState, len(ap.aggs))}
+	}
+
+	// the groups come out in GROUP BY order unless sorted
+	sorted := []*aggGroup{}
+	for _, g := range groups {
+		sorted = append(sorted, g)
+	}
+	slices.SortFunc(sorted, func(a *aggGroup, b *aggGroup) int { return strings.Compare(a.key, b.key) })
+	out := []Row{}
+	seen := map[string]bool{}
+	for _, g := range sorted {
+		row := slices.Clone(g.row)
+		for i, agg := range ap.aggs {
+			row = append(row, g.states[i].result(agg))
+		}
+		if ap.having != nil && !isTrue(evalExpr(ap.having, row)) {
+			continue
+		}
+		row = project(ap.exprs, row)
+		if ap.distinct {
+			key := string(distinctKey(row))
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		out = append(out, row)
+	}
+	slices.SortStableFunc(out, func(a Row, b Row) int {
+		for _, c := range ap.sort {
+			r := compareNull(&a[c.col], &b[c.col])
+			if c.desc {
+				r = -r
+			}
+			if r != 0 {
+				return r
+			}
+		}
+		return 0
+	})
+
+	skip, left := ap.offset, ap.limit
+	for _, row := range out {
+		if left == 0 {
+			break
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+		left--
+	}
+	return nil
+}
+
+// compareNull is Cell.Compare with cells without a type first.
+func compareNull(a *Cell, b *Cell) int {
+	if a.Type == 0 || b.Type == 0 {
+		return cmp.Compare(a.Type, b.Type)
+	}
+	return a.Compare(b)
+}
@@ -0,0 +1,97 @@
+package kvdb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLAggregate(t *testing.T) {
+	db := NewDB(&MemKV{})
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	exec := func(s string) SQLResult {
+		r, err := db.ExecStmt(parseStmt(t, s))
+		require.Nil(t, err, s)
+		return r
+	}
+	query := func(s string) []string {
+		got := []string{}
+		for _, row := range exec(s).Values {
+			cells := []string{}
+			for i := range row {
+				cells = append(cells, formatCell(&row[i]))
+			}
+			got = append(got, strings.Join(cells, " "))
+		}
+		return got
+	}
+	exec("create table t (a int64, g string, v int64, primary key (a));")
+	for a := 1; a <= 10; a++ {
+		exec(fmt.Sprintf("insert into t values (%d, 'g%d', %d);", a, a%3, a*a))
+	}
+
+	s := "select count(*), count(v), sum(v), avg(v) as mean, min(g), max(v) from t;"
+	assert.Equal(t, []string{"COUNT(*)", "COUNT(v)", "SUM(v)", "mean", "MIN(g)", "MAX(v)"}, exec(s).Header)
+	assert.Equal(t, []string{"10 10 385 38 'g0' 100"}, query(s))
+	assert.Equal(t, []string{"3 50"}, query("select count(*), sum(v) from t where a >= 3 and a <= 5;"))
+	assert.Equal(t, []string{"1 1"}, query("select count(*) > 5, max(v) = 100 from t;"))
+
+	// groups come out in GROUP BY order
+	assert.Equal(t, []string{"'g0' 3 126", "'g1' 4 166", "'g2' 3 93"}, query("select g, count(*), sum(v) from t group by g;"))
+	assert.Equal(t, []string{"'g1' 4"}, query("select g, count(a) from t group by g having count(*) > 3;"))
+	assert.Equal(t, []string{"'g0' 126", "'g2' 93"}, query("select g, sum(v) as s from t group by g having sum(v) < 150 order by s desc;"))
+	assert.Equal(t, []string{"'g1'"}, query("select g from t group by g order by g desc limit 1 offset 1;"))
+	assert.Equal(t, []string{"'g2' 3", "'g1' 4", "'g0' 3"}, query("select g as grp, count(*) from t group by g order by g desc;"))
+	assert.Equal(t, []string{"'g1' 1"}, query("select g, min(a) from t where a < 5 and g != 'g2' group by g having g = 'g1';"))
+
+	// no rows
+	assert.Equal(t, []string{"0 NULL NULL NULL NULL"}, query("select count(*), sum(v), min(a), max(g), avg(v) from t where a > 100;"))
+	assert.Equal(t, []string{"1"}, query("select max(a) is null from t where a > 100;"))
+	assert.Empty(t, query("select count(*) from t where a > 100 having max(a) > 1;"))
+	assert.Empty(t, query("select g, count(*) from t where a > 100 group by g;"))
+	exec("create table e (a int64, v int64, primary key (a));")
+	r := exec("select count(*), sum(v), avg(v), min(a), max(v) from e;")
+	assert.Equal(t, []Row{{{Type: TypeI64, I64: 0}, {}, {}, {}, {}}}, r.Values)
+	assert.Equal(t, []string{"0 NULL NULL"}, query("select count(v), sum(v), max(a) from e having sum(v) is null;"))
+	assert.Equal(t, []string{"'PROJECT SUM(v)'", "'  AGGREGATE SUM(v)'", "'    FULL SCAN e'"}, query("explain select sum(v) from e;"))
+
+	// MIN and MAX of the primary key read the first and the last row
+	assert.Equal(t, []string{"1 10"}, query("select min(a), max(a) from t;"))
+	assert.Equal(t, []string{"5 9"}, query("select min(a), max(a) from t where v > 10 and g != 'g1';"))
+	lines := query("explain analyze select max(a), min(a) as first from t;")
+	assert.Equal(t, []string{
+		"'PROJECT MAX(a), MIN(a) AS first'",
+		"'  AGGREGATE MAX(a), MIN(a) FROM FIRST AND LAST ROW'",
+		"'    FULL SCAN t'",
+		"'rows examined: 2'",
+		"'rows returned: 1'",
+	}, lines[:5])
+	assert.Equal(t, []string{
+		"'PROJECT g, COUNT(*) AS n'",
+		"'  LIMIT 2'",
+		"'    SORT n DESC'",
+		"'      HAVING (COUNT(*) > 1 AND g != \\'g0\\') AND MAX(v) > 0'",
+		"'        AGGREGATE COUNT(*), MAX(v) GROUP BY g'",
+		"'          FILTER a != 2'",
+		"'            RANGE SCAN t (a) > (1)'",
+	}, query("explain select g, count(*) as n from t where a > 1 and a != 2 group by g having count(*) > 1 and g != 'g0' and max(v) > 0 order by n desc limit 2;"))
+
+	for _, s := range []string{
+		"select a, count(*) from t;", "select count(sum(v)) from t;", "select a from t where count(*) > 1;",
+		"select sum(g) from t;", "select min(*) from t;", "select g from t group by g order by a;",
+		"select g from t group by nope;", "select * from t group by g;",
+	} {
+		_, err := db.ExecStmt(parseStmt(t, s))
+		assert.NotNil(t, err, s)
+	}
+	for _, s := range []string{"select foo(a) from t;", "select count(a from t;", "select g from t group by;"} {
+		p := NewParser(s)
+		_, err := p.parseStmt()
+		assert.NotNil(t, err, s)
+	}
+}
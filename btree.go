@@ -0,0 +1,271 @@
+package kvdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	pageSize   = 4096
+	nodeHeader = 4
+	// limits that keep a single leaf entry within one page; there are no
+	// overflow pages, so a longer key or value (such as a row with a long
+	// string) fails with ErrTooLarge on EngineBTree
+	maxKeySize = 1000
+	maxValSize = 3000
+)
+
+// ErrTooLarge is returned for a key or value over the limits of the engine.
+var ErrTooLarge = errors.New("key or value too large")
+
+// bnode is a decoded B+tree page. Leaves hold the key-value pairs; internal
+// nodes hold the first key of every child. The first key of an internal
+// node is treated as -inf so that every key has a child to descend into.
+type bnode struct {
+	leaf bool
+	keys [][]byte
+	vals [][]byte // leaf only
+	kids []uint64 // internal only
+}
+
+/*
+All integer fields are encoded using Little Endian.
+
+Page Format
+| leaf    | nkeys   | entries ... |
+| 2 bytes | 2 bytes |             |
+
+Leaf entry:     | key size 2B | val size 2B | key | val |
+Internal entry: | child page 8B | key size 2B | key |
+*/
+func (node *bnode) entrySize(i int) int {
+	if node.leaf {
+		return 4 + len(node.keys[i]) + len(node.vals[i])
+	}
+	return 10 + len(node.keys[i])
+}
+
+func (node *bnode) size() int {
+	size := nodeHeader
+	for i := range node.keys {
+		size += node.entrySize(i)
+	}
+	return size
+}
+
+func (node *bnode) encode() []byte {
+	check(node.size() <= pageSize)
+	page := make([]byte, nodeHeader, pageSize)
+	if node.leaf {
+		binary.LittleEndian.PutUint16(page[0:2], 1)
+	}
+	binary.LittleEndian.PutUint16(page[2:4], uint16(len(node.keys)))
+	for i, key := range node.keys {
+		if node.leaf {
+			page = binary.LittleEndian.AppendUint16(page, uint16(len(key)))
+			page = binary.LittleEndian.AppendUint16(page, uint16(len(node.vals[i])))
+			page = append(page, key...)
+			page = append(page, node.vals[i]...)
+		} else {
+			page = binary.LittleEndian.AppendUint64(page, node.kids[i])
+			page = binary.LittleEndian.AppendUint16(page, uint16(len(key)))
+			page = append(page, key...)
+		}
+	}
+	return page[:pageSize]
+}
+
+var errBadPage = errors.New("corrupt B+tree page")
+
+func decodeNode(page []byte) (*bnode, error) {
+	if len(page) < nodeHeader {
+		return nil, errBadPage
+	}
+	node := &bnode{leaf: binary.LittleEndian.Uint16(page[0:2]) == 1}
+	n := int(binary.LittleEndian.Uint16(page[2:4]))
+	data := page[nodeHeader:]
+	for i := 0; i < n; i++ {
+		if node.leaf {
+			if len(data) < 4 {
+				return nil, errBadPage
+			}
+			klen := int(binary.LittleEndian.Uint16(data[0:2]))
+			vlen := int(binary.LittleEndian.Uint16(data[2:4]))
+			if len(data) < 4+klen+vlen {
+				return nil, errBadPage
+			}
+			node.keys = append(node.keys, data[4:4+klen])
+			node.vals = append(node.vals, data[4+klen:4+klen+vlen])
+			data = data[4+klen+vlen:]
+		} else {
+			if len(data) < 10 {
+				return nil, errBadPage
+			}
+			node.kids = append(node.kids, binary.LittleEndian.Uint64(data[0:8]))
+			klen := int(binary.LittleEndian.Uint16(data[8:10]))
+			if len(data) < 10+klen {
+				return nil, errBadPage
+			}
+			node.keys = append(node.keys, data[10:10+klen])
+			data = data[10+klen:]
+		}
+	}
+	return node, nil
+}
+
+// childIndex picks the child whose range contains key.
+func childIndex(node *bnode, key []byte) int {
+	idx, found := BinarySearchFunc(node.keys, key, bytes.Compare)
+	if found || idx == 0 {
+		return idx
+	}
+	return idx - 1
+}
+
+// splitNode breaks an oversized node into pieces that each fit a page.
+func splitNode(node *bnode) []*bnode {
+	if node.size() <= pageSize {
+		return []*bnode{node}
+	}
+	parts := []*bnode{}
+	cur := &bnode{leaf: node.leaf}
+	size := nodeHeader
+	for i := range node.keys {
+		if len(cur.keys) > 0 && size+node.entrySize(i) > pageSize {
+			parts = append(parts, cur)
+			cur = &bnode{leaf: node.leaf}
+			size = nodeHeader
+		}
+		cur.keys = append(cur.keys, node.keys[i])
+		if node.leaf {
+			cur.vals = append(cur.vals, node.vals[i])
+		} else {
+			cur.kids = append(cur.kids, node.kids[i])
+		}
+		size += node.entrySize(i)
+	}
+	return append(parts, cur)
+}
+
+// mergeNodes concatenates two siblings, left before right.
+func mergeNodes(left *bnode, right *bnode) *bnode {
+	return &bnode{
+		leaf: left.leaf,
+		keys: append(append([][]byte{}, left.keys...), right.keys...),
+		vals: append(append([][]byte{}, left.vals...), right.vals...),
+		kids: append(append([]uint64{}, left.kids...), right.kids...),
+	}
+}
+
+// pageStore is what the tree algorithms need from a transaction.
+type pageStore interface {
+	load(ptr uint64) (*bnode, error)
+	alloc(node *bnode) uint64
+	release(ptr uint64)
+}
+
+// treeInsert upserts the pair into the subtree and returns the nodes that
+// replace it: one, or several after a split.
+func treeInsert(store pageStore, node *bnode, key []byte, val []byte) ([]*bnode, error) {
+	updated := &bnode{leaf: node.leaf}
+	if node.leaf {
+		idx, found := BinarySearchFunc(node.keys, key, bytes.Compare)
+		updated.keys = append(updated.keys, node.keys[:idx]...)
+		updated.vals = append(updated.vals, node.vals[:idx]...)
+		updated.keys = append(updated.keys, key)
+		updated.vals = append(updated.vals, val)
+		if found {
+			idx++
+		}
+		updated.keys = append(updated.keys, node.keys[idx:]...)
+		updated.vals = append(updated.vals, node.vals[idx:]...)
+		return splitNode(updated), nil
+	}
+
+	idx := childIndex(node, key)
+	kid, err := store.load(node.kids[idx])
+	if err != nil {
+		return nil, err
+	}
+	parts, err := treeInsert(store, kid, key, val)
+	if err != nil {
+		return nil, err
+	}
+	store.release(node.kids[idx])
+	replaceKids(store, updated, node, idx, idx+1, parts...)
+	return splitNode(updated), nil
+}
+
+// treeDelete removes key from the subtree. It returns the replacement node,
+// which may be empty, or nil when the key is not there.
+func treeDelete(store pageStore, node *bnode, key []byte) (*bnode, error) {
+	if node.leaf {
+		idx, found := BinarySearchFunc(node.keys, key, bytes.Compare)
+		if !found {
+			return nil, nil
+		}
+		updated := &bnode{leaf: true}
+		updated.keys = append(append(updated.keys, node.keys[:idx]...), node.keys[idx+1:]...)
+		updated.vals = append(append(updated.vals, node.vals[:idx]...), node.vals[idx+1:]...)
+		return updated, nil
+	}
+
+	idx := childIndex(node, key)
+	kid, err := store.load(node.kids[idx])
+	if err != nil {
+		return nil, err
+	}
+	newKid, err := treeDelete(store, kid, key)
+	if err != nil || newKid == nil {
+		return nil, err
+	}
+	store.release(node.kids[idx])
+
+	updated := &bnode{}
+	switch {
+	case len(newKid.keys) == 0:
+		replaceKids(store, updated, node, idx, idx+1)
+	case newKid.size() < pageSize/4:
+		// merge the small node into a sibling when the result fits
+		if idx > 0 {
+			left, err := store.load(node.kids[idx-1])
+			if err != nil {
+				return nil, err
+			}
+			if left.size()+newKid.size()-nodeHeader <= pageSize {
+				store.release(node.kids[idx-1])
+				replaceKids(store, updated, node, idx-1, idx+1, mergeNodes(left, newKid))
+				return updated, nil
+			}
+		}
+		if idx+1 < len(node.kids) {
+			right, err := store.load(node.kids[idx+1])
+			if err != nil {
+				return nil, err
+			}
+			if right.size()+newKid.size()-nodeHeader <= pageSize {
+				store.release(node.kids[idx+1])
+				replaceKids(store, updated, node, idx, idx+2, mergeNodes(newKid, right))
+				return updated, nil
+			}
+		}
+		replaceKids(store, updated, node, idx, idx+1, newKid)
+	default:
+		replaceKids(store, updated, node, idx, idx+1, newKid)
+	}
+	return updated, nil
+}
+
+// replaceKids fills out with the children of node where [from, to) is
+// swapped for freshly allocated pages holding kids.
+func replaceKids(store pageStore, out *bnode, node *bnode, from int, to int, kids ...*bnode) {
+	out.keys = append(out.keys, node.keys[:from]...)
+	out.kids = append(out.kids, node.kids[:from]...)
+	for _, kid := range kids {
+		out.keys = append(out.keys, kid.keys[0])
+		out.kids = append(out.kids, store.alloc(kid))
+	}
+	out.keys = append(out.keys, node.keys[to:]...)
+	out.kids = append(out.kids, node.kids[to:]...)
+}
@@ -0,0 +1,524 @@
+package kvdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc64"
+	"os"
+	"runtime"
+	"sync"
+)
+
+/*
+The B+tree file is an array of pages. Pages 0 and 1 hold two copies of the
+meta record, written alternately, so a torn meta write leaves the previous
+version in place. A commit writes its new pages first, fsyncs, then writes
+the meta record pointing at the new root and fsyncs again.
+
+Meta record (Little Endian)
+| magic   | version | root    | npages  | checksum |
+| 8 bytes | 8 bytes | 8 bytes | 8 bytes | 8 bytes  |
+
+Pages are never modified in place, so an iterator can keep reading the tree
+of the version it started on. Freed pages go on a free list, but only become
+reusable once no iterator of an older version is alive. The free list is not
+stored on disk; Open rebuilds it from the pages the tree cannot reach, which
+also recovers pages written by a commit that crashed before its meta record.
+*/
+const (
+	metaPages = 2
+	metaSize  = 40
+)
+
+var btreeMagic = []byte("TinyBT01")
+
+var ErrBadMeta = errors.New("no valid B+tree meta page")
+
+type btree struct {
+	fp       *os.File
+	syncMode SyncMode
+
+	version uint64
+	root    uint64 // 0 for an empty tree
+	npages  uint64
+
+	free    []uint64    // pages that can be reused right away
+	pending []freedPage // freed pages an older iterator may still read
+
+	rmu     sync.Mutex     // guards readers; iterators release from finalizers
+	readers map[uint64]int // live iterators per version
+}
+
+type freedPage struct {
+	ptr     uint64
+	version uint64 // first version that no longer uses the page
+}
+
+func (tree *btree) open(fileName string, mode SyncMode) (err error) {
+	if tree.fp, err = createFileSync(fileName); err != nil {
+		return err
+	}
+	tree.syncMode = mode
+	tree.readers = map[uint64]int{}
+	if err = tree.loadMeta(); err == nil {
+		err = tree.rebuildFreeList()
+	}
+	if err != nil {
+		_ = tree.fp.Close()
+	}
+	return err
+}
+
+func (tree *btree) close() error {
+	return tree.fp.Close()
+}
+
+func (tree *btree) loadMeta() error {
+	st, err := tree.fp.Stat()
+	if err != nil {
+		return err
+	}
+	if st.Size() == 0 {
+		tree.version, tree.root, tree.npages = 0, 0, metaPages
+		return tree.writeMeta(tree.version, tree.root, tree.npages)
+	}
+
+	found := false
+	for slot := int64(0); slot < metaPages; slot++ {
+		data := make([]byte, metaSize)
+		if _, err := tree.fp.ReadAt(data, slot*pageSize); err != nil {
+			continue
+		}
+		if !bytes.Equal(data[:8], btreeMagic) {
+			continue
+		}
+		if crc64.Checksum(data[:32], tab) != binary.LittleEndian.Uint64(data[32:40]) {
+			continue
+		}
+		version := binary.LittleEndian.Uint64(data[8:16])
+		if !found || version > tree.version {
+			tree.version = version
+			tree.root = binary.LittleEndian.Uint64(data[16:24])
+			tree.npages = binary.LittleEndian.Uint64(data[24:32])
+			found = true
+		}
+	}
+	if !found {
+		return ErrBadMeta
+	}
+	return nil
+}
+
+func (tree *btree) writeMeta(version uint64, root uint64, npages uint64) error {
+	data := append([]byte{}, btreeMagic...)
+	data = binary.LittleEndian.AppendUint64(data, version)
+	data = binary.LittleEndian.AppendUint64(data, root)
+	data = binary.LittleEndian.AppendUint64(data, npages)
+	data = binary.LittleEndian.AppendUint64(data, crc64.Checksum(data, tab))
+	if _, err := tree.fp.WriteAt(data, int64(version%metaPages)*pageSize); err != nil {
+		return err
+	}
+	return tree.sync()
+}
+
+func (tree *btree) sync() error {
+	if tree.syncMode == SyncNone {
+		return nil
+	}
+	return tree.fp.Sync()
+}
+
+// rebuildFreeList marks the pages reachable from the root; the rest are
+// free. All leaves sit at the same depth, so only internal nodes are read.
+func (tree *btree) rebuildFreeList() error {
+	used := make([]bool, tree.npages)
+	if tree.root != 0 {
+		height := 1
+		for ptr := tree.root; ; height++ {
+			node, err := tree.read(ptr)
+			if err != nil {
+				return err
+			}
+			if node.leaf {
+				break
+			}
+			ptr = node.kids[0]
+		}
+
+		type item struct {
+			ptr   uint64
+			depth int
+		}
+		used[tree.root] = true
+		stack := []item{{tree.root, 1}}
+		for len(stack) > 0 {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if top.depth == height {
+				continue // a leaf
+			}
+			node, err := tree.read(top.ptr)
+			if err != nil {
+				return err
+			}
+			for _, kid := range node.kids {
+				if kid < metaPages || kid >= tree.npages || used[kid] {
+					return errBadPage
+				}
+				used[kid] = true
+				stack = append(stack, item{kid, top.depth + 1})
+			}
+		}
+	}
+	tree.free, tree.pending = nil, nil
+	for ptr := tree.npages - 1; ptr >= metaPages; ptr-- {
+		if !used[ptr] {
+			tree.free = append(tree.free, ptr)
+		}
+	}
+	return nil
+}
+
+func (tree *btree) read(ptr uint64) (*bnode, error) {
+	page := make([]byte, pageSize)
+	if _, err := tree.fp.ReadAt(page, int64(ptr)*pageSize); err != nil {
+		return nil, err
+	}
+	return decodeNode(page)
+}
+
+func (tree *btree) get(key []byte) ([]byte, bool, error) {
+	return tree.getAt(tree.root, key)
+}
+
+// getAt looks the key up in the tree of an older root, which the caller
+// keeps pinned.
+func (tree *btree) getAt(root uint64, key []byte) ([]byte, bool, error) {
+	if root == 0 {
+		return nil, false, nil
+	}
+	node, err := tree.read(root)
+	for err == nil && !node.leaf {
+		node, err = tree.read(node.kids[childIndex(node, key)])
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if idx, found := BinarySearchFunc(node.keys, key, bytes.Compare); found {
+		return node.vals[idx], true, nil
+	}
+	return nil, false, nil
+}
+
+// write applies the entries in one copy-on-write transaction.
+func (tree *btree) write(ents []Entry) error {
+	for i := range ents {
+		if len(ents[i].key) > maxKeySize || len(ents[i].val) > maxValSize {
+			return ErrTooLarge
+		}
+	}
+	tree.reclaim()
+
+	tx := btreeTx{tree: tree, root: tree.root, npages: tree.npages, dirty: map[uint64]*bnode{}}
+	for i := range ents {
+		var err error
+		if ents[i].deleted {
+			err = tx.del(ents[i].key)
+		} else {
+			err = tx.set(ents[i].key, ents[i].val)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.commit()
+}
+
+// reclaim moves pending pages that no live iterator can see to the free list.
+func (tree *btree) reclaim() {
+	tree.rmu.Lock()
+	oldest, pinned := uint64(0), false
+	for version := range tree.readers {
+		if !pinned || version < oldest {
+			oldest, pinned = version, true
+		}
+	}
+	tree.rmu.Unlock()
+
+	kept := tree.pending[:0]
+	for _, page := range tree.pending {
+		if !pinned || page.version <= oldest {
+			tree.free = append(tree.free, page.ptr)
+		} else {
+			kept = append(kept, page)
+		}
+	}
+	tree.pending = kept
+}
+
+type btreeTx struct {
+	tree     *btree
+	root     uint64
+	npages   uint64
+	nfree    int               // pages taken from the tail of tree.free
+	dirty    map[uint64]*bnode // pages written by this transaction
+	recycled []uint64          // dirty pages that were released again
+	freed    []uint64          // committed pages this transaction dropped
+}
+
+func (tx *btreeTx) load(ptr uint64) (*bnode, error) {
+	if node, ok := tx.dirty[ptr]; ok {
+		return node, nil
+	}
+	return tx.tree.read(ptr)
+}
+
+func (tx *btreeTx) alloc(node *bnode) uint64 {
+	var ptr uint64
+	switch free := tx.tree.free; {
+	case len(tx.recycled) > 0:
+		ptr = tx.recycled[len(tx.recycled)-1]
+		tx.recycled = tx.recycled[:len(tx.recycled)-1]
+	case tx.nfree < len(free):
+		tx.nfree++
+		ptr = free[len(free)-tx.nfree]
+	default:
+		ptr = tx.npages
+		tx.npages++
+	}
+	tx.dirty[ptr] = node
+	return ptr
+}
+
+func (tx *btreeTx) release(ptr uint64) {
+	if _, ok := tx.dirty[ptr]; ok {
+		delete(tx.dirty, ptr)
+		tx.recycled = append(tx.recycled, ptr)
+	} else {
+		tx.freed = append(tx.freed, ptr)
+	}
+}
+
+func (tx *btreeTx) set(key []byte, val []byte) error {
+	if tx.root == 0 {
+		tx.root = tx.alloc(&bnode{leaf: true, keys: [][]byte{key}, vals: [][]byte{val}})
+		return nil
+	}
+	root, err := tx.load(tx.root)
+	if err != nil {
+		return err
+	}
+	parts, err := treeInsert(tx, root, key, val)
+	if err != nil {
+		return err
+	}
+	tx.release(tx.root)
+	if len(parts) == 1 {
+		tx.root = tx.alloc(parts[0])
+		return nil
+	}
+	// the root split, grow the tree by one level
+	newRoot := &bnode{}
+	replaceKids(tx, newRoot, &bnode{}, 0, 0, parts...)
+	tx.root = tx.alloc(newRoot)
+	return nil
+}
+
+func (tx *btreeTx) del(key []byte) error {
+	if tx.root == 0 {
+		return nil
+	}
+	root, err := tx.load(tx.root)
+	if err != nil {
+		return err
+	}
+	updated, err := treeDelete(tx, root, key)
+	if err != nil || updated == nil {
+		return err
+	}
+	tx.release(tx.root)
+	// shrink the tree while the root has a single child
+	for !updated.leaf && len(updated.kids) == 1 {
+		ptr := updated.kids[0]
+		if updated, err = tx.load(ptr); err != nil {
+			return err
+		}
+		tx.release(ptr)
+	}
+	if len(updated.keys) == 0 {
+		tx.root = 0
+	} else {
+		tx.root = tx.alloc(updated)
+	}
+	return nil
+}
+
+func (tx *btreeTx) commit() error {
+	tree := tx.tree
+	if tx.root == tree.root && len(tx.dirty) == 0 {
+		return nil
+	}
+	for ptr, node := range tx.dirty {
+		if _, err := tree.fp.WriteAt(node.encode(), int64(ptr)*pageSize); err != nil {
+			return err
+		}
+	}
+	if err := tree.sync(); err != nil {
+		return err
+	}
+	version := tree.version + 1
+	if err := tree.writeMeta(version, tx.root, tx.npages); err != nil {
+		return err
+	}
+
+	tree.version, tree.root, tree.npages = version, tx.root, tx.npages
+	tree.free = append(tree.free[:len(tree.free)-tx.nfree], tx.recycled...)
+	for _, ptr := range tx.freed {
+		tree.pending = append(tree.pending, freedPage{ptr: ptr, version: version})
+	}
+	return nil
+}
+
+// btreeIter holds the path from the root to the current leaf entry.
+type btreeIter struct {
+	tree    *btree
+	version uint64
+	pinned  bool // until Close
+	path    []*bnode
+	pos     []int // the leaf position is -1 or len(keys) when out of range
+}
+
+func (tree *btree) seek(key []byte) (kvCursor, error) {
+	return tree.seekAt(tree.root, tree.version, key)
+}
+
+func (tree *btree) seekAt(root uint64, version uint64, key []byte) (kvCursor, error) {
+	iter := &btreeIter{tree: tree, version: version}
+	if root != 0 {
+		node, err := tree.read(root)
+		for {
+			if err != nil {
+				return nil, err
+			}
+			iter.path = append(iter.path, node)
+			if node.leaf {
+				break
+			}
+			idx := childIndex(node, key)
+			iter.pos = append(iter.pos, idx)
+			node, err = tree.read(node.kids[idx])
+		}
+		idx, _ := BinarySearchFunc(node.keys, key, bytes.Compare)
+		iter.pos = append(iter.pos, idx)
+		if idx == len(node.keys) {
+			// every key in this leaf is smaller, move on to the next leaf
+			iter.pos[len(iter.pos)-1] = idx - 1
+			if err := iter.Next(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// pin the version until Close, or until the iterator is garbage
+	// collected if it is never closed
+	tree.pin(version)
+	iter.pinned = true
+	runtime.SetFinalizer(iter, (*btreeIter).Close)
+	return iter, nil
+}
+
+func (iter *btreeIter) Close() {
+	if !iter.pinned {
+		return
+	}
+	iter.pinned = false
+	runtime.SetFinalizer(iter, nil)
+	iter.tree.unpin(iter.version)
+}
+
+// pin keeps the pages of a version from being reused.
+func (tree *btree) pin(version uint64) {
+	tree.rmu.Lock()
+	tree.readers[version]++
+	tree.rmu.Unlock()
+}
+
+func (tree *btree) unpin(version uint64) {
+	tree.rmu.Lock()
+	if tree.readers[version]--; tree.readers[version] == 0 {
+		delete(tree.readers, version)
+	}
+	tree.rmu.Unlock()
+}
+
+func (iter *btreeIter) leaf() (*bnode, int) {
+	last := len(iter.path) - 1
+	return iter.path[last], iter.pos[last]
+}
+
+func (iter *btreeIter) Valid() bool {
+	if len(iter.path) == 0 {
+		return false
+	}
+	leaf, pos := iter.leaf()
+	return 0 <= pos && pos < len(leaf.keys)
+}
+
+func (iter *btreeIter) Key() []byte {
+	leaf, pos := iter.leaf()
+	return leaf.keys[pos]
+}
+
+func (iter *btreeIter) Val() []byte {
+	leaf, pos := iter.leaf()
+	return leaf.vals[pos]
+}
+
+func (iter *btreeIter) Next() error { return iter.step(1) }
+
+func (iter *btreeIter) Prev() error { return iter.step(-1) }
+
+func (iter *btreeIter) step(dir int) error {
+	if len(iter.path) == 0 {
+		return nil
+	}
+	last := len(iter.path) - 1
+	leaf, pos := iter.leaf()
+	if pos+dir >= 0 && pos+dir < len(leaf.keys) {
+		iter.pos[last] = pos + dir
+		return nil
+	}
+	if pos < 0 || pos >= len(leaf.keys) {
+		return nil // already out of range on this side
+	}
+
+	// find the lowest ancestor that has a sibling subtree in this direction
+	level := last - 1
+	for level >= 0 {
+		next := iter.pos[level] + dir
+		if next >= 0 && next < len(iter.path[level].kids) {
+			break
+		}
+		level--
+	}
+	if level < 0 {
+		iter.pos[last] = pos + dir
+		return nil
+	}
+
+	iter.pos[level] += dir
+	for ; level < last; level++ {
+		node, err := iter.tree.read(iter.path[level].kids[iter.pos[level]])
+		if err != nil {
+			return err
+		}
+		iter.path[level+1] = node
+		if dir > 0 {
+			iter.pos[level+1] = 0
+		} else {
+			iter.pos[level+1] = len(node.keys) - 1
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package kvdb
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBNodeEncode(t *testing.T) {
+	leaf := &bnode{leaf: true, keys: [][]byte{[]byte("a"), []byte("bc")}, vals: [][]byte{[]byte("1"), {}}}
+	page := leaf.encode()
+	assert.Equal(t, pageSize, len(page))
+	assert.Equal(t, []byte{1, 0, 2, 0, 1, 0, 1, 0, 'a', '1', 2, 0, 0, 0, 'b', 'c'}, page[:16])
+	decoded, err := decodeNode(page)
+	require.Nil(t, err)
+	assert.Equal(t, leaf.keys, decoded.keys)
+	assert.Equal(t, leaf.size(), decoded.size())
+
+	internal := &bnode{keys: [][]byte{{}, []byte("m")}, kids: []uint64{5, 9}}
+	decoded, err = decodeNode(internal.encode())
+	require.Nil(t, err)
+	assert.False(t, decoded.leaf)
+	assert.Equal(t, internal.kids, decoded.kids)
+	assert.Equal(t, []byte("m"), decoded.keys[1])
+}
+
+func openBTree(t *testing.T) *KV {
+	kv := &KV{Engine: EngineBTree}
+	kv.log.FileName = ".test_db"
+	kv.SyncMode = SyncNone
+	require.Nil(t, kv.Open())
+	return kv
+}
+
+func TestBTreeRandom(t *testing.T) {
+	// long keys make a deep tree with few entries per node
+	for _, pad := range []int{0, 900} {
+		testBTreeRandom(t, pad)
+	}
+}
+
+func testBTreeRandom(t *testing.T, pad int) {
+	os.Remove(".test_db")
+	defer os.Remove(".test_db")
+	kv := openBTree(t)
+
+	ref := map[string]string{}
+	verify := func() {
+		keys := []string{}
+		for k := range ref {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+
+		got := []string{}
+		iter, err := kv.Seek(nil)
+		require.Nil(t, err)
+		for ; iter.Valid(); iter.Next() {
+			got = append(got, string(iter.Key()))
+			require.Equal(t, ref[string(iter.Key())], string(iter.Val()))
+		}
+		require.Equal(t, keys, got)
+
+		// and backwards from past the end
+		iter.Prev()
+		for i := len(keys) - 1; i >= 0; i-- {
+			require.True(t, iter.Valid())
+			require.Equal(t, keys[i], string(iter.Key()))
+			iter.Prev()
+		}
+		require.False(t, iter.Valid())
+
+		for _, k := range keys[:min(len(keys), 50)] {
+			val, ok, err := kv.Get([]byte(k))
+			require.True(t, ok && err == nil && string(val) == ref[k])
+		}
+	}
+
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 2000; i++ {
+			k := fmt.Sprintf("key%0*d", pad+5, rand.IntN(5000))
+			switch rand.IntN(3) {
+			case 0:
+				_, err := kv.Del([]byte(k))
+				require.Nil(t, err)
+				delete(ref, k)
+			default:
+				v := fmt.Sprintf("%0*d", rand.IntN(200), i)
+				_, err := kv.Set([]byte(k), []byte(v))
+				require.Nil(t, err)
+				ref[k] = v
+			}
+		}
+		verify()
+		require.Nil(t, kv.Close())
+		kv = openBTree(t)
+		verify()
+	}
+
+	// deleting everything empties the tree
+	batch := kv.NewBatch()
+	for k := range ref {
+		batch.Del([]byte(k))
+	}
+	require.Nil(t, kv.Apply(batch))
+	ref = map[string]string{}
+	verify()
+	assert.Equal(t, uint64(0), kv.tree.root)
+	require.Nil(t, kv.Close())
+	kv = openBTree(t)
+	verify()
+	require.Nil(t, kv.Close())
+}
+
+func TestBTreeFreeList(t *testing.T) {
+	os.Remove(".test_db")
+	defer os.Remove(".test_db")
+	kv := openBTree(t)
+	defer kv.Close()
+
+	val := make([]byte, 500)
+	for i := 0; i < 200; i++ {
+		_, err := kv.Set([]byte(fmt.Sprintf("k%03d", i)), val)
+		require.Nil(t, err)
+	}
+	size := kv.tree.npages
+
+	// overwriting the same keys must reuse the freed pages
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 200; i++ {
+			val[0] = byte(round + 1)
+			_, err := kv.Set([]byte(fmt.Sprintf("k%03d", i)), slices.Clone(val))
+			require.Nil(t, err)
+		}
+	}
+	assert.LessOrEqual(t, kv.tree.npages, size+5)
+
+	_, err := kv.Set(make([]byte, maxKeySize+1), nil)
+	assert.Equal(t, ErrTooLarge, err)
+}
+
+func TestBTreeSnapshot(t *testing.T) {
+	os.Remove(".test_db")
+	defer os.Remove(".test_db")
+	kv := openBTree(t)
+	defer kv.Close()
+
+	for i := 0; i < 300; i++ {
+		_, err := kv.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("old"))
+		require.Nil(t, err)
+	}
+	iter, err := kv.Seek([]byte("k"))
+	require.Nil(t, err)
+
+	// rewrite every page the iterator may still read
+	for i := 0; i < 300; i++ {
+		_, err := kv.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("new"))
+		require.Nil(t, err)
+		_, err = kv.Del([]byte(fmt.Sprintf("k%03d", i)))
+		require.Nil(t, err)
+		runtime.GC()
+	}
+
+	count := 0
+	for ; iter.Valid(); iter.Next() {
+		assert.Equal(t, fmt.Sprintf("k%03d", count), string(iter.Key()))
+		assert.Equal(t, "old", string(iter.Val()))
+		count++
+	}
+	assert.Equal(t, 300, count)
+
+	// Close unpins the version at once, and only once
+	iter.Close()
+	iter.Close()
+	kv.tree.rmu.Lock()
+	assert.Empty(t, kv.tree.readers)
+	kv.tree.rmu.Unlock()
+}
+
+func TestBTreeDB(t *testing.T) {
+	os.Remove(".test_db")
+	defer os.Remove(".test_db")
+
+	db := DB{}
+	db.KV.Engine = EngineBTree
+	db.KV.log.FileName = ".test_db"
+	require.Nil(t, db.Open())
+
+	s := "create table t (k int64, v string, primary key (k));"
+	_, err := db.ExecStmt(parseStmt(t, s))
+	require.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		s = fmt.Sprintf("insert into t values (%d, 'v%d');", i, i)
+		r, err := db.ExecStmt(parseStmt(t, s))
+		require.True(t, err == nil && r.Updated == 1)
+	}
+	require.Nil(t, db.Close())
+
+	db = DB{}
+	db.KV.Engine = EngineBTree
+	db.KV.log.FileName = ".test_db"
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	r, err := db.ExecStmt(parseStmt(t, "select v from t where k = 42;"))
+	require.Nil(t, err)
+	assert.Equal(t, []Row{{Cell{Type: TypeStr, Str: []byte("v42")}}}, r.Values)
+
+	schema, err := db.GetSchema("t")
+	require.Nil(t, err)
+	row := schema.NewRow()
+	row[0] = Cell{Type: TypeI64, I64: 90}
+	iter, err := db.Seek(&schema, row)
+	got := []int64{}
+	for ; err == nil && iter.Valid(); err = iter.Next() {
+		got = append(got, iter.Row()[0].I64)
+	}
+	require.Nil(t, err)
+	assert.Equal(t, []int64{90, 91, 92, 93, 94, 95, 96, 97, 98, 99}, got)
+}
+
+func TestBTreeDBTooLarge(t *testing.T) {
+	os.Remove(".test_db")
+	defer os.Remove(".test_db")
+
+	db := DB{}
+	db.KV.Engine = EngineBTree
+	db.KV.log.FileName = ".test_db"
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	_, err := db.ExecStmt(parseStmt(t, "create table t (k int64, v string, primary key (k));"))
+	require.Nil(t, err)
+	s := fmt.Sprintf("insert into t values (1, '%s');", strings.Repeat("x", 2900))
+	r, err := db.ExecStmt(parseStmt(t, s))
+	require.True(t, err == nil && r.Updated == 1)
+
+	// the row no longer fits in a page
+	s = fmt.Sprintf("insert into t values (2, '%s');", strings.Repeat("x", 3000))
+	_, err = db.ExecStmt(parseStmt(t, s))
+	assert.ErrorIs(t, err, ErrTooLarge)
+	r, err = db.ExecStmt(parseStmt(t, "select k from t;"))
+	require.Nil(t, err)
+	assert.Len(t, r.Values, 1)
+}
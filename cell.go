@@ -1,6 +1,8 @@
 package kvdb
 
 import (
+	"bytes"
+	"cmp"
 	"encoding/binary"
 	"errors"
 	"slices"
@@ -117,3 +119,16 @@ func (cell *Cell) DecodeVal(data []byte) (rest []byte, err error) {
 		panic("Can't be decoded")
 	}
 }
+
+// Compare orders two cells of the same type like their key encodings do.
+func (cell *Cell) Compare(other *Cell) int {
+	check(cell.Type == other.Type)
+	switch cell.Type {
+	case TypeI64:
+		return cmp.Compare(cell.I64, other.I64)
+	case TypeStr:
+		return bytes.Compare(cell.Str, other.Str)
+	default:
+		panic("Can't be compared")
+	}
+}
@@ -0,0 +1,244 @@
+package kvdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// run these with -race
+
+func TestKVConcurrent(t *testing.T) {
+	// fsyncs are slow, so the group commit run is shorter
+	runs := []struct {
+		mode   SyncMode
+		ops    int
+		engine Engine
+	}{{SyncNone, 200, EngineLog}, {SyncBatched, 100, EngineLog}, {SyncNone, 200, EngineLSM}}
+	for _, run := range runs {
+		mode, ops := run.mode, run.ops
+		// a tiny memtable keeps the flushes and compactions busy
+		kv := KV{CompactRatio: 4, Engine: run.engine, MemtableSize: 1024}
+		kv.log.FileName = ".test_db"
+		kv.SyncMode = mode
+		removeLSM()
+
+		err := kv.Open()
+		require.Nil(t, err)
+
+		const writers, readers = 4, 4
+		key := func(w int, i int) []byte { return []byte(fmt.Sprintf("w%d_%03d", w, i)) }
+
+		stop := make(chan struct{})
+		readWg := sync.WaitGroup{}
+		for r := 0; r < readers; r++ {
+			readWg.Add(1)
+			go func() {
+				defer readWg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					case <-time.After(100 * time.Microsecond):
+					}
+					_, _, err := kv.Get(key(0, 0))
+					assert.Nil(t, err)
+
+					iter, err := kv.Seek([]byte("w"))
+					assert.Nil(t, err)
+					var prev []byte
+					for i := 0; i < 50 && iter.Valid(); i++ {
+						assert.True(t, prev == nil || bytes.Compare(prev, iter.Key()) < 0)
+						prev = iter.Key()
+						assert.Nil(t, iter.Next())
+					}
+				}
+			}()
+		}
+
+		writeWg := sync.WaitGroup{}
+		for w := 0; w < writers; w++ {
+			writeWg.Add(1)
+			go func(w int) {
+				defer writeWg.Done()
+				for i := 0; i < ops; i++ {
+					_, err := kv.Set(key(w, i), []byte("v"))
+					assert.Nil(t, err)
+					if i%2 == 1 {
+						_, err = kv.Del(key(w, i-1))
+						assert.Nil(t, err)
+					}
+					if i%10 == 0 {
+						batch := kv.NewBatch()
+						batch.Set(key(w, i), []byte("b"))
+						batch.Del(key(w, ops+i))
+						assert.Nil(t, kv.Apply(batch))
+					}
+				}
+			}(w)
+		}
+		writeWg.Wait()
+		close(stop)
+		readWg.Wait()
+
+		check := func() {
+			for w := 0; w < writers; w++ {
+				for i := 0; i < ops; i++ {
+					_, ok, err := kv.Get(key(w, i))
+					assert.True(t, err == nil && ok == (i%2 == 1))
+				}
+			}
+		}
+		check()
+		require.Nil(t, kv.Close())
+		require.Nil(t, kv.Open())
+		check()
+		require.Nil(t, kv.Close())
+		removeLSM()
+	}
+}
+
+func TestDBConcurrent(t *testing.T) {
+	db := DB{}
+	db.KV.log.FileName = ".test_db"
+	defer os.Remove(db.KV.log.FileName)
+
+	os.Remove(db.KV.log.FileName)
+	err := db.Open()
+	require.Nil(t, err)
+	defer db.Close()
+
+	s := "create table t (k int64, a int64, b int64, primary key (k));"
+	_, err = db.ExecStmt(parseStmt(t, s))
+	require.Nil(t, err)
+	_, err = db.ExecStmt(parseStmt(t, "insert into t values (0, 0, 0);"))
+	require.Nil(t, err)
+
+	const n = 100
+	wg := sync.WaitGroup{}
+	for _, col := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(col string) {
+			defer wg.Done()
+			for i := 1; i <= n; i++ {
+				s := fmt.Sprintf("update t set %s = %d where k = 0;", col, i)
+				_, err := db.ExecStmt(parseStmt(t, s))
+				assert.Nil(t, err)
+			}
+		}(col)
+	}
+	for w := 1; w <= 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				s := fmt.Sprintf("insert into t values (%d, %d, %d);", w*n+i, w, i)
+				r, err := db.ExecStmt(parseStmt(t, s))
+				assert.True(t, err == nil && r.Updated == 1)
+
+				s = fmt.Sprintf("select a, b from t where k = %d;", w*n+i)
+				r, err = db.ExecStmt(parseStmt(t, s))
+				assert.Nil(t, err)
+				assert.Equal(t, []Row{{Cell{Type: TypeI64, I64: int64(w)}, Cell{Type: TypeI64, I64: int64(i)}}}, r.Values)
+			}
+		}(w)
+	}
+	for r := 0; r < 2; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			schema, err := db.GetSchema("t")
+			assert.Nil(t, err)
+			for i := 0; i < 20; i++ {
+				row := schema.NewRow()
+				row[0] = Cell{Type: TypeI64, I64: 0}
+				iter, err := db.Seek(&schema, row)
+				assert.Nil(t, err)
+				prev := int64(-1)
+				for ; err == nil && iter.Valid(); err = iter.Next() {
+					assert.Less(t, prev, iter.Row()[0].I64)
+					prev = iter.Row()[0].I64
+				}
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// neither UPDATE may lose the other's column
+	r, err := db.ExecStmt(parseStmt(t, "select a, b from t where k = 0;"))
+	require.Nil(t, err)
+	assert.Equal(t, []Row{{Cell{Type: TypeI64, I64: n}, Cell{Type: TypeI64, I64: n}}}, r.Values)
+
+	schema, err := db.GetSchema("t")
+	require.Nil(t, err)
+	row := schema.NewRow()
+	row[0] = Cell{Type: TypeI64, I64: 0}
+	iter, err := db.Seek(&schema, row)
+	count := 0
+	for ; err == nil && iter.Valid(); err = iter.Next() {
+		count++
+	}
+	require.Nil(t, err)
+	assert.Equal(t, 1+4*n, count)
+}
+
+func TestDBScanWhileWriting(t *testing.T) {
+	db := DB{}
+	db.KV.log.FileName = ".test_db"
+	defer os.Remove(db.KV.log.FileName)
+
+	os.Remove(db.KV.log.FileName)
+	err := db.Open()
+	require.Nil(t, err)
+	defer db.Close()
+
+	schema := &Schema{
+		Table: "t",
+		Cols:  []Column{{Name: "k", Type: TypeI64}, {Name: "v", Type: TypeI64}},
+		PKey:  []int{0},
+	}
+	const n = 200
+	for i := int64(0); i < n; i += 2 {
+		_, err := db.Insert(schema, Row{{Type: TypeI64, I64: i}, {Type: TypeI64, I64: 0}})
+		require.Nil(t, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := int64(0); i < n; i++ {
+			var err error
+			if i%2 == 0 {
+				_, err = db.Delete(schema, Row{{Type: TypeI64, I64: i}, {}})
+			} else {
+				_, err = db.Insert(schema, Row{{Type: TypeI64, I64: i}, {Type: TypeI64, I64: 1}})
+			}
+			assert.Nil(t, err)
+		}
+	}()
+
+	// the scan sees exactly the rows that existed when it started
+	iter, err := db.Seek(schema, Row{{Type: TypeI64, I64: 0}, {}})
+	require.Nil(t, err)
+	keys := []int64{}
+	for ; err == nil && iter.Valid(); err = iter.Next() {
+		assert.Equal(t, int64(0), iter.Row()[1].I64)
+		keys = append(keys, iter.Row()[0].I64)
+		time.Sleep(10 * time.Microsecond)
+	}
+	require.Nil(t, err)
+	<-done
+
+	expected := []int64{}
+	for i := int64(0); i < n; i += 2 {
+		expected = append(expected, i)
+	}
+	assert.Equal(t, expected, keys)
+}
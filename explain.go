@@ -0,0 +1,251 @@
+package kvdb
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// execExplain describes the plan of the query, one node per row with the
+// inputs of a node indented under it. EXPLAIN ANALYZE also runs the query.
+func (tx *Tx) execExplain(stmt *StmtExplain) ([]Row, error) {
+	schema, err := tx.GetSchema(stmt.stmt.table)
+	if err != nil {
+		return nil, err
+	}
+	exprs, names, err := bindColumns(&schema, stmt.stmt.cols)
+	if err != nil {
+		return nil, err
+	}
+	project := []string{}
+	for i := range exprs {
+		if col := formatExpr(exprs[i]); col != names[i] {
+			project = append(project, col+" AS "+names[i])
+		} else {
+			project = append(project, col)
+		}
+	}
+	nodes := []string{"PROJECT " + strings.Join(project, ", ")}
+	var plan *queryPlan
+	var run func(fn func(Row) error) error
+	if isAggregate(stmt.stmt, exprs) {
+		ap, err := planAggregate(&schema, stmt.stmt, exprs, names)
+		if err != nil {
+			return nil, err
+		}
+		plan = ap.plan
+		nodes = append(nodes, ap.describe(&schema, names)...)
+		run = func(fn func(Row) error) error { return tx.execAggregate(&schema, ap, fn) }
+	} else {
+		if plan, err = planSelect(&schema, stmt.stmt, exprs, names); err != nil {
+			return nil, err
+		}
+		if stmt.stmt.distinct {
+			plan.setDistinct(&schema, exprs)
+		}
+		run = func(fn func(Row) error) error { return tx.execQuery(&schema, plan, fn) }
+	}
+	nodes = append(nodes, plan.describe(&schema)...)
+
+	lines := []string{}
+	for depth, node := range nodes {
+		lines = append(lines, strings.Repeat("  ", depth)+node)
+	}
+	if stmt.analyze {
+		start, returned := time.Now(), 0
+		err = run(func(Row) error {
+			returned++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines,
+			fmt.Sprintf("rows examined: %d", plan.examined),
+			fmt.Sprintf("rows returned: %d", returned),
+			fmt.Sprintf("time: %v", time.Since(start)),
+		)
+	}
+
+	out := []Row{}
+	for _, line := range lines {
+		out = append(out, Row{{Type: TypeStr, Str: []byte(line)}})
+	}
+	return out, nil
+}
+
+// describe lists the nodes that fold the rows into the output rows of an
+// aggregate query, named names.
+func (ap *aggPlan) describe(schema *Schema, names []string) []string {
+	distinct := ""
+	if ap.distinct {
+		distinct = "DISTINCT"
+	}
+	nodes := describeOrder(ap.limit, ap.offset, distinct, ap.sort, names)
+	if ap.having != nil {
+		// the group row has the GROUP BY columns and the aggregates by name
+		nodes = append(nodes, "HAVING "+formatExpr(ap.having))
+	}
+	aggs := []string{}
+	for _, agg := range ap.aggs {
+		aggs = append(aggs, formatExpr(agg))
+	}
+	node := []string{"AGGREGATE"}
+	if len(aggs) > 0 {
+		node = append(node, strings.Join(aggs, ", "))
+	}
+	if len(ap.group) > 0 {
+		group := []string{}
+		for _, col := range ap.group {
+			group = append(group, schema.Cols[col].Name)
+		}
+		node = append(node, "GROUP BY "+strings.Join(group, ", "))
+	}
+	if ap.ends {
+		node = append(node, "FROM FIRST AND LAST ROW")
+	}
+	return append(nodes, strings.Join(node, " "))
+}
+
+// describe lists the nodes of the plan from the rows it returns down to
+// the access path.
+func (plan *queryPlan) describe(schema *Schema) []string {
+	names := []string{}
+	for _, col := range schema.Cols {
+		names = append(names, col.Name)
+	}
+	distinct := ""
+	if plan.distinct != nil && plan.adjacent {
+		distinct = "DISTINCT ADJACENT"
+	} else if plan.distinct != nil {
+		distinct = "DISTINCT"
+	}
+	nodes := describeOrder(plan.limit, plan.offset, distinct, plan.sort, names)
+	if len(plan.filter) > 0 {
+		conds := []string{}
+		for _, e := range plan.filter {
+			conds = append(conds, formatOperand(e))
+		}
+		nodes = append(nodes, "FILTER "+strings.Join(conds, " AND "))
+	}
+
+	var access string
+	switch plan.kind {
+	case planPoint:
+		access = "POINT GET " + schema.Table + " " + describePoints(schema, plan.points)
+	case planRange:
+		access = "RANGE SCAN " + schema.Table + " " + describeRange(schema, schema.PKey, plan.scan)
+	case planIndex:
+		access = "INDEX SCAN " + schema.Table + " USING " + plan.index.Name + " " +
+			describeRange(schema, plan.index.Cols, plan.scan)
+	case planFull:
+		access = "FULL SCAN " + schema.Table
+	}
+	if plan.scan.Reverse {
+		access += " REVERSE"
+	}
+	return append(nodes, access)
+}
+
+// describeOrder lists the LIMIT, DISTINCT and SORT nodes, if any, over
+// rows with the columns names.
+func describeOrder(limit int64, offset int64, distinct string, sort []sortCol, names []string) []string {
+	nodes, bounds := []string{}, []string{}
+	if limit >= 0 {
+		bounds = append(bounds, "LIMIT "+strconv.FormatInt(limit, 10))
+	}
+	if offset > 0 {
+		bounds = append(bounds, "OFFSET "+strconv.FormatInt(offset, 10))
+	}
+	if len(bounds) > 0 {
+		nodes = append(nodes, strings.Join(bounds, " "))
+	}
+	if distinct != "" {
+		nodes = append(nodes, distinct)
+	}
+	if len(sort) > 0 {
+		cols := []string{}
+		for _, c := range sort {
+			if c.desc {
+				cols = append(cols, names[c.col]+" DESC")
+			} else {
+				cols = append(cols, names[c.col])
+			}
+		}
+		nodes = append(nodes, "SORT "+strings.Join(cols, ", "))
+	}
+	return nodes
+}
+
+// describeRange writes the bounds of a range as tuple comparisons.
+func describeRange(schema *Schema, cols []int, r ScanRange) string {
+	tuple := func(vals []Cell) (names string, values string) {
+		n, v := []string{}, []string{}
+		for i := range vals {
+			n = append(n, schema.Cols[cols[i]].Name)
+			v = append(v, formatCell(&vals[i]))
+		}
+		return "(" + strings.Join(n, ", ") + ")", "(" + strings.Join(v, ", ") + ")"
+	}
+	same := slices.EqualFunc(r.Start, r.End, func(a Cell, b Cell) bool { return a.Compare(&b) == 0 })
+	if same && r.StartIncl && r.EndIncl {
+		names, values := tuple(r.Start)
+		return names + " = " + values
+	}
+
+	bounds := []string{}
+	if len(r.Start) > 0 {
+		names, values := tuple(r.Start)
+		op := " > "
+		if r.StartIncl {
+			op = " >= "
+		}
+		bounds = append(bounds, names+op+values)
+	}
+	if len(r.End) > 0 {
+		names, values := tuple(r.End)
+		op := " < "
+		if r.EndIncl {
+			op = " <= "
+		}
+		bounds = append(bounds, names+op+values)
+	}
+	return strings.Join(bounds, " AND ")
+}
+
+// describePoints writes the primary keys of point gets as a tuple equality
+// or an IN list of tuples.
+func describePoints(schema *Schema, points []Row) string {
+	names, keys := []string{}, []string{}
+	for _, col := range schema.PKey {
+		names = append(names, schema.Cols[col].Name)
+	}
+	for _, row := range points {
+		vals := []string{}
+		for _, col := range schema.PKey {
+			vals = append(vals, formatCell(&row[col]))
+		}
+		keys = append(keys, "("+strings.Join(vals, ", ")+")")
+	}
+	if len(keys) == 1 {
+		return "(" + strings.Join(names, ", ") + ") = " + keys[0]
+	}
+	return "(" + strings.Join(names, ", ") + ") IN (" + strings.Join(keys, ", ") + ")"
+}
+
+// formatCell writes the cell as a SQL value.
+func formatCell(cell *Cell) string {
+	switch cell.Type {
+	case TypeI64:
+		return strconv.FormatInt(cell.I64, 10)
+	case TypeStr:
+		s := strings.ReplaceAll(string(cell.Str), `\`, `\\`)
+		return "'" + strings.ReplaceAll(s, "'", `\'`) + "'"
+	case 0:
+		return "NULL"
+	default:
+		panic("unreachable")
+	}
+}
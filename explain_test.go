@@ -0,0 +1,111 @@
+package kvdb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplain(t *testing.T) {
+	db := NewDB(&MemKV{})
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	exec := func(s string) []string {
+		r, err := db.ExecStmt(parseStmt(t, s))
+		require.Nil(t, err)
+		lines := []string{}
+		for _, row := range r.Values {
+			lines = append(lines, string(row[0].Str))
+		}
+		return lines
+	}
+	exec("create table t (a int64, b string, c int64, primary key (a, b));")
+	for a := 0; a < 4; a++ {
+		exec(fmt.Sprintf("insert into t values (%d, 'x', %d);", a, a%2))
+		exec(fmt.Sprintf("insert into t values (%d, 'y', %d);", a, a%2))
+	}
+	exec("create index by_c on t (c);")
+
+	assert.Equal(t, []string{
+		"PROJECT c",
+		"  POINT GET t (a, b) = (1, 'it\\'s')",
+	}, exec("explain select c from t where a = 1 and b = 'it\\'s';"))
+	assert.Equal(t, []string{
+		"PROJECT a, b",
+		"  FILTER c = 1",
+		"    RANGE SCAN t (a, b) > (1, 'x') AND (a) <= (1) REVERSE",
+	}, exec("explain select a, b from t where a = 1 and b > 'x' and c = 1 order by a desc;"))
+	assert.Equal(t, []string{
+		"PROJECT a",
+		"  FILTER a < 3",
+		"    INDEX SCAN t USING by_c (c) = (1)",
+	}, exec("explain select a from t where c = 1 and a < 3;"))
+	assert.Equal(t, []string{
+		"PROJECT a",
+		"  FULL SCAN t",
+	}, exec("explain select a from t;"))
+	assert.Equal(t, []string{
+		"PROJECT a, b, c, c = 1 AS one",
+		"  FULL SCAN t",
+	}, exec("explain select *, c = 1 as one from t;"))
+	assert.Equal(t, []string{
+		"PROJECT a",
+		"  FILTER (c = 1 OR b = 'x') AND NOT a = 2",
+		"    RANGE SCAN t (a) >= (1)",
+	}, exec("explain select a from t where 1 <= a and (c = 1 or b = 'x') and not a = 2;"))
+	assert.Equal(t, []string{
+		"PROJECT c",
+		"  POINT GET t (a, b) IN ((1, 'x'), (1, 'y'), (3, 'x'), (3, 'y')) REVERSE",
+	}, exec("explain select c from t where a in (3, 1) and b in ('y', 'x') order by a desc, b desc;"))
+	assert.Equal(t, []string{
+		"PROJECT a",
+		"  FILTER b LIKE 'x%y'",
+		"    RANGE SCAN t (a, b) >= (2, 'x') AND (a, b) < (2, 'y')",
+	}, exec("explain select a from t where a = 2 and b like 'x%y';"))
+
+	// EXPLAIN alone does not run the query, ANALYZE does
+	lines := exec("explain analyze select a from t where c = 1 and a < 3;")
+	require.Len(t, lines, 6)
+	assert.Equal(t, "rows examined: 4", lines[3])
+	assert.Equal(t, "rows returned: 2", lines[4])
+	assert.True(t, strings.HasPrefix(lines[5], "time: "))
+
+	assert.Equal(t, []string{
+		"PROJECT a",
+		"  LIMIT 2 OFFSET 1",
+		"    SORT c DESC, b",
+		"      INDEX SCAN t USING by_c (c) >= (0)",
+	}, exec("explain select a from t where c >= 0 order by c desc, b limit 2 offset 1;"))
+	assert.Equal(t, []string{
+		"PROJECT a",
+		"  OFFSET 3",
+		"    FULL SCAN t REVERSE",
+	}, exec("explain select a from t order by a desc offset 3;"))
+
+	// LIMIT stops the scan unless the rows need sorting
+	lines = exec("explain analyze select a from t limit 3 offset 1;")
+	assert.Equal(t, []string{"rows examined: 4", "rows returned: 3"}, lines[3:5])
+	lines = exec("explain analyze select a from t order by c limit 3 offset 1;")
+	assert.Equal(t, []string{"rows examined: 8", "rows returned: 3"}, lines[4:6])
+
+	assert.Equal(t, []string{
+		"PROJECT a",
+		"  DISTINCT ADJACENT",
+		"    RANGE SCAN t (a) > (0)",
+	}, exec("explain select distinct a from t where a > 0;"))
+	assert.Equal(t, []string{
+		"PROJECT c",
+		"  LIMIT 1",
+		"    DISTINCT",
+		"      FULL SCAN t",
+	}, exec("explain select distinct c from t limit 1;"))
+	lines = exec("explain analyze select distinct a from t limit 2;")
+	assert.Equal(t, []string{"rows examined: 3", "rows returned: 2"}, lines[4:6])
+
+	_, err := db.ExecStmt(parseStmt(t, "explain select nope from t;"))
+	assert.NotNil(t, err)
+}
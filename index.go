@@ -0,0 +1,335 @@
+package kvdb
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+)
+
+// Index is a secondary index of a table. Every row has one entry in it, a
+// key made of the indexed columns followed by the primary key, so that the
+// rows sort by the indexed columns. The row itself stays in the table.
+// A unique index keys the entry on the indexed columns alone and keeps the
+// primary key in the value, so that two transactions adding the same
+// values write the same key and conflict.
+type Index struct {
+	Name   string
+	Cols   []int // indexes to the Cols of the Schema
+	Unique bool  // no two rows have the same indexed columns
+}
+
+var ErrDuplicate = errors.New("duplicate key in unique index")
+
+func (schema *Schema) GetIndex(name string) (*Index, error) {
+	for i := range schema.Indexes {
+		if schema.Indexes[i].Name == name {
+			return &schema.Indexes[i], nil
+		}
+	}
+	return nil, errors.New("index is not found")
+}
+
+// encodeIndexPrefix encodes the leading indexed columns in vals.
+func encodeIndexPrefix(schema *Schema, idx *Index, vals []Cell) (key []byte) {
+	check(len(vals) <= len(idx.Cols))
+	key = append(key, "@index_"+schema.Table+"\x00"+idx.Name+"\x00"...)
+	for i := range vals {
+		check(schema.Cols[idx.Cols[i]].Type == vals[i].Type)
+		key = vals[i].EncodeKey(key)
+	}
+	return key
+}
+
+// encodeIndexEntry returns the key and the value of the index entry of row.
+func (row Row) encodeIndexEntry(schema *Schema, idx *Index) (key []byte, val []byte) {
+	key = encodeIndexPrefix(schema, idx, subsetRow(row, idx.Cols))
+	val = []byte{}
+	for _, col := range schema.PKey {
+		if idx.Unique {
+			val = row[col].EncodeKey(val)
+		} else {
+			key = row[col].EncodeKey(key)
+		}
+	}
+	return key, val
+}
+
+func (row Row) encodeIndexKey(schema *Schema, idx *Index) []byte {
+	key, _ := row.encodeIndexEntry(schema, idx)
+	return key
+}
+
+// decodeIndexEntry decodes the indexed and the primary key columns.
+func (row Row) decodeIndexEntry(schema *Schema, idx *Index, key []byte, val []byte) (err error) {
+	prefix := encodeIndexPrefix(schema, idx, nil)
+	if !bytes.HasPrefix(key, prefix) {
+		return ErrOutOfRange
+	}
+	if key, err = row.decodeCols(schema, idx.Cols, key[len(prefix):]); err != nil {
+		return err
+	}
+	if idx.Unique {
+		if len(key) > 0 {
+			return errors.New("Trailing garbage detected")
+		}
+		key = val
+	}
+	if key, err = row.decodeCols(schema, schema.PKey, key); err != nil {
+		return err
+	}
+	if len(key) > 0 {
+		return errors.New("Trailing garbage detected")
+	}
+	return nil
+}
+
+// decodeCols decodes the cols from the start of data.
+func (row Row) decodeCols(schema *Schema, cols []int, data []byte) (rest []byte, err error) {
+	for _, col := range cols {
+		cell := Cell{Type: schema.Cols[col].Type}
+		if data, err = cell.DecodeKey(data); err != nil {
+			return nil, err
+		}
+		row[col] = cell
+	}
+	return data, nil
+}
+
+// setRow writes the row and moves its index entries.
+func (tx *Tx) setRow(schema *Schema, row Row, mode UpdateMode) (updated bool, err error) {
+	key, val := row.EncodeKey(schema), row.EncodeVal(schema)
+	if val == nil {
+		val = []byte{} // every column is in the key; nil marks a deletion
+	}
+	old, existed, err := tx.get(key)
+	if err != nil || !mode.updating(old, existed, val) {
+		return false, err
+	}
+	for i := range schema.Indexes {
+		if err = tx.checkUnique(schema, &schema.Indexes[i], row); err != nil {
+			return false, err
+		}
+	}
+	if existed {
+		if err = tx.delIndexes(schema, row, old); err != nil {
+			return false, err
+		}
+	}
+	tx.write(key, val)
+	for i := range schema.Indexes {
+		tx.write(row.encodeIndexEntry(schema, &schema.Indexes[i]))
+	}
+	return true, nil
+}
+
+// checkUnique fails with ErrDuplicate if another row has the indexed
+// columns of row in a unique index.
+func (tx *Tx) checkUnique(schema *Schema, idx *Index, row Row) error {
+	if !idx.Unique {
+		return nil
+	}
+	key, own := row.encodeIndexEntry(schema, idx)
+	pkey, found, err := tx.get(key)
+	if err == nil && found && !bytes.Equal(pkey, own) {
+		err = ErrDuplicate
+	}
+	return err
+}
+
+// delRow deletes the row with the primary key of row and its index entries.
+func (tx *Tx) delRow(schema *Schema, row Row) (deleted bool, err error) {
+	key := row.EncodeKey(schema)
+	old, existed, err := tx.get(key)
+	if err != nil || !existed {
+		return false, err
+	}
+	if err = tx.delIndexes(schema, row, old); err != nil {
+		return false, err
+	}
+	tx.write(key, nil)
+	return true, nil
+}
+
+// delIndexes deletes the index entries of the stored row val with the
+// primary key of row.
+func (tx *Tx) delIndexes(schema *Schema, row Row, val []byte) error {
+	if len(schema.Indexes) == 0 {
+		return nil
+	}
+	old := schema.NewRow()
+	for _, col := range schema.PKey {
+		old[col] = row[col]
+	}
+	if err := old.DecodeVal(schema, val); err != nil {
+		return err
+	}
+	for i := range schema.Indexes {
+		tx.write(old.encodeIndexKey(schema, &schema.Indexes[i]), nil)
+	}
+	return nil
+}
+
+// SeekIndex positions an iterator at the first row whose indexed columns
+// are >= vals, which holds values for the leading ones, and walks the rows
+// in index order. The iterator reads a snapshot until Close.
+func (db *DB) SeekIndex(schema *Schema, index string, vals []Cell) (*RowIterator, error) {
+	snap := db.Storage.Snapshot()
+	iter, err := seekIndex(schema, index, vals, snap.Seek, snap.Get)
+	if err != nil {
+		snap.Release()
+		return nil, err
+	}
+	iter.snap = snap
+	return iter, nil
+}
+
+func (tx *Tx) SeekIndex(schema *Schema, index string, vals []Cell) (*RowIterator, error) {
+	return seekIndex(schema, index, vals, tx.seek, tx.get)
+}
+
+func seekIndex(schema *Schema, index string, vals []Cell,
+	seek func([]byte) (*KVIterator, error), get func([]byte) ([]byte, bool, error),
+) (*RowIterator, error) {
+	idx, err := schema.GetIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	lo := encodeIndexPrefix(schema, idx, nil)
+	iter, err := seek(encodeIndexPrefix(schema, idx, vals))
+	if err != nil {
+		return nil, err
+	}
+	riter := &RowIterator{
+		schema: schema, iter: iter, row: schema.NewRow(), lo: lo, hi: prefixEnd(lo),
+		index: idx, get: get,
+	}
+	if err := riter.load(); err != nil {
+		riter.Close()
+		return nil, err
+	}
+	return riter, nil
+}
+
+// ScanIndex is Scan over the index of the table. The iterator reads a
+// snapshot until Close.
+func (db *DB) ScanIndex(schema *Schema, index string, r ScanRange) (*RowIterator, error) {
+	snap := db.Storage.Snapshot()
+	iter, err := scanIndex(schema, index, r, snap.Seek, snap.Get)
+	if err != nil {
+		snap.Release()
+		return nil, err
+	}
+	iter.snap = snap
+	return iter, nil
+}
+
+func (tx *Tx) ScanIndex(schema *Schema, index string, r ScanRange) (*RowIterator, error) {
+	return scanIndex(schema, index, r, tx.seek, tx.get)
+}
+
+func scanIndex(schema *Schema, index string, r ScanRange,
+	seek func([]byte) (*KVIterator, error), get func([]byte) ([]byte, bool, error),
+) (*RowIterator, error) {
+	idx, err := schema.GetIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	riter := &RowIterator{schema: schema, row: schema.NewRow(), index: idx, get: get}
+	encode := func(vals []Cell) []byte { return encodeIndexPrefix(schema, idx, vals) }
+	if err := riter.seekRange(r, encode, seek); err != nil {
+		riter.Close()
+		return nil, err
+	}
+	return riter, nil
+}
+
+// loadIndex decodes the current index entry and reads its row.
+func (iter *RowIterator) loadIndex() (bool, error) {
+	err := iter.row.decodeIndexEntry(iter.schema, iter.index, iter.iter.Key(), iter.iter.Val())
+	if err == ErrOutOfRange {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	val, ok, err := iter.get(iter.row.EncodeKey(iter.schema))
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, errors.New("index entry without a row")
+	}
+	return true, iter.row.DecodeVal(iter.schema, val)
+}
+
+func (tx *Tx) execCreateIndex(stmt *StmtCreateIndex) error {
+	schema, err := tx.GetSchema(stmt.table)
+	if err != nil {
+		return err
+	}
+	if _, err := schema.GetIndex(stmt.name); err == nil {
+		return errors.New("Index under the name: " + stmt.name + " already exists!")
+	}
+	idx := Index{Name: stmt.name, Unique: stmt.unique}
+	if idx.Cols, err = lookupColumns(schema.Cols, stmt.cols); err != nil {
+		return err
+	}
+
+	// backfill from the existing rows
+	seen := map[string]bool{}
+	iter, err := tx.Scan(&schema, ScanRange{})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for ; err == nil && iter.Valid(); err = iter.Next() {
+		row := iter.Row()
+		if idx.Unique {
+			prefix := string(encodeIndexPrefix(&schema, &idx, subsetRow(row, idx.Cols)))
+			if seen[prefix] {
+				return ErrDuplicate
+			}
+			seen[prefix] = true
+		}
+		tx.write(row.encodeIndexEntry(&schema, &idx))
+	}
+	if err != nil {
+		return err
+	}
+
+	schema.Indexes = append(slices.Clone(schema.Indexes), idx)
+	return tx.putSchema(schema)
+}
+
+func (tx *Tx) execDropIndex(stmt *StmtDropIndex) error {
+	schema, err := tx.GetSchema(stmt.table)
+	if err != nil {
+		return err
+	}
+	idx, err := schema.GetIndex(stmt.name)
+	if err != nil {
+		return err
+	}
+
+	prefix := encodeIndexPrefix(&schema, idx, nil)
+	keys := [][]byte{}
+	iter, err := tx.seek(prefix)
+	if err != nil {
+		return err
+	}
+	for ; err == nil && iter.Valid() && bytes.HasPrefix(iter.Key(), prefix); err = iter.Next() {
+		keys = append(keys, iter.Key())
+	}
+	iter.Close()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		tx.write(key, nil)
+	}
+
+	schema.Indexes = slices.DeleteFunc(slices.Clone(schema.Indexes), func(i Index) bool {
+		return i.Name == stmt.name
+	})
+	return tx.putSchema(schema)
+}
@@ -0,0 +1,252 @@
+package kvdb
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndex(t *testing.T) {
+	db := NewDB(&MemKV{})
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	schema := &Schema{
+		Table: "t",
+		Cols: []Column{
+			{Name: "id", Type: TypeI64},
+			{Name: "name", Type: TypeStr},
+			{Name: "age", Type: TypeI64},
+		},
+		PKey: []int{0},
+		Indexes: []Index{
+			{Name: "by_age", Cols: []int{2}},
+			{Name: "by_name_age", Cols: []int{1, 2}},
+		},
+	}
+	row := func(id int64, name string, age int64) Row {
+		return Row{{Type: TypeI64, I64: id}, {Type: TypeStr, Str: []byte(name)}, {Type: TypeI64, I64: age}}
+	}
+	i64 := func(v int64) Cell { return Cell{Type: TypeI64, I64: v} }
+	str := func(v string) Cell { return Cell{Type: TypeStr, Str: []byte(v)} }
+	ids := func(iter *RowIterator, err error) []int64 {
+		require.Nil(t, err)
+		defer iter.Close()
+		got := []int64{}
+		for ; err == nil && iter.Valid(); err = iter.Next() {
+			got = append(got, iter.Row()[0].I64)
+		}
+		require.Nil(t, err)
+		return got
+	}
+
+	for _, r := range []Row{row(1, "bob", 30), row(2, "amy", 20), row(3, "bob", 10), row(4, "cat", 20)} {
+		updated, err := db.Insert(schema, r)
+		require.True(t, updated && err == nil)
+	}
+	assert.Equal(t, []int64{3, 2, 4, 1}, ids(db.SeekIndex(schema, "by_age", nil)))
+	assert.Equal(t, []int64{2, 4, 1}, ids(db.SeekIndex(schema, "by_age", []Cell{i64(11)})))
+	assert.Equal(t, []int64{3, 1, 4}, ids(db.SeekIndex(schema, "by_name_age", []Cell{str("bob")})))
+	assert.Equal(t, []int64{1, 4}, ids(db.SeekIndex(schema, "by_name_age", []Cell{str("bob"), i64(11)})))
+
+	// updates move the entries, deletes remove them
+	updated, err := db.Update(schema, row(1, "bob", 5))
+	require.True(t, updated && err == nil)
+	updated, err = db.Upsert(schema, row(4, "al", 20))
+	require.True(t, updated && err == nil)
+	deleted, err := db.Delete(schema, row(2, "", 0))
+	require.True(t, deleted && err == nil)
+	assert.Equal(t, []int64{1, 3, 4}, ids(db.SeekIndex(schema, "by_age", nil)))
+	assert.Equal(t, []int64{4, 1, 3}, ids(db.SeekIndex(schema, "by_name_age", nil)))
+
+	iter, err := db.SeekIndex(schema, "by_age", []Cell{i64(7)})
+	require.True(t, err == nil && iter.Valid())
+	assert.Equal(t, row(3, "bob", 10), iter.Row())
+	require.Nil(t, iter.Prev())
+	assert.Equal(t, row(1, "bob", 5), iter.Row())
+	iter.Close()
+
+	// a failed insert leaves the indexes alone
+	updated, err = db.Insert(schema, row(3, "zed", 99))
+	require.True(t, !updated && err == nil)
+	assert.Equal(t, []int64{4, 1, 3}, ids(db.SeekIndex(schema, "by_name_age", nil)))
+
+	// the index writes are part of the transaction
+	tx := db.Begin()
+	_, err = tx.Insert(schema, row(5, "abe", 1))
+	require.Nil(t, err)
+	assert.Equal(t, []int64{5, 1, 3, 4}, ids(tx.SeekIndex(schema, "by_age", nil)))
+	assert.Equal(t, []int64{1, 3, 4}, ids(db.SeekIndex(schema, "by_age", nil)))
+	require.Nil(t, tx.Rollback())
+
+	_, err = db.SeekIndex(schema, "nope", nil)
+	assert.NotNil(t, err)
+	// Close and the failed seek released every snapshot
+	assert.Empty(t, db.Storage.(*MemKV).snaps)
+}
+
+func TestSQLIndex(t *testing.T) {
+	db := DB{}
+	db.KV.log.FileName = ".test_db"
+	defer os.Remove(db.KV.log.FileName)
+
+	os.Remove(db.KV.log.FileName)
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	exec := func(s string) (SQLResult, error) {
+		return db.ExecStmt(parseStmt(t, s))
+	}
+	for _, s := range []string{
+		"create table t (id int64, name string, age int64, primary key (id));",
+		"insert into t values (1, 'bob', 30);",
+		"insert into t values (2, 'amy', 20);",
+		"insert into t values (3, 'bob', 10);",
+		"create index by_age on t (age);",
+	} {
+		_, err := exec(s)
+		require.Nil(t, err)
+	}
+	// the name is not unique
+	_, err := exec("create unique index by_name on t (name);")
+	assert.Equal(t, ErrDuplicate, err)
+	_, err = exec("create index by_age on t (name);")
+	assert.NotNil(t, err)
+	_, err = exec("create unique index by_name on t (name, age);")
+	require.Nil(t, err)
+	_, err = exec("insert into t values (4, 'bob', 30);")
+	assert.Equal(t, ErrDuplicate, err)
+	_, err = exec("update t set age = 30 where id = 3;")
+	assert.Equal(t, ErrDuplicate, err)
+	_, err = exec("update t set age = 31 where id = 3;")
+	require.Nil(t, err)
+
+	ids := func(index string) []int64 {
+		schema, err := db.GetSchema("t")
+		require.Nil(t, err)
+		got := []int64{}
+		iter, err := db.SeekIndex(&schema, index, nil)
+		require.Nil(t, err)
+		defer iter.Close()
+		for ; err == nil && iter.Valid(); err = iter.Next() {
+			got = append(got, iter.Row()[0].I64)
+		}
+		require.Nil(t, err)
+		return got
+	}
+	assert.Equal(t, []int64{2, 1, 3}, ids("by_age"))
+	assert.Equal(t, []int64{2, 1, 3}, ids("by_name"))
+
+	// the definitions are stored with the schema
+	require.Nil(t, db.Close())
+	db = DB{}
+	db.KV.log.FileName = ".test_db"
+	require.Nil(t, db.Open())
+	assert.Equal(t, []int64{2, 1, 3}, ids("by_name"))
+
+	// a writer that read the schema before CREATE INDEX would miss the index
+	tx := db.Begin()
+	schema, err := tx.GetSchema("t")
+	require.Nil(t, err)
+	_, err = tx.Insert(&schema, Row{{Type: TypeI64, I64: 5}, {Type: TypeStr, Str: []byte("cat")}, {Type: TypeI64, I64: 1}})
+	require.Nil(t, err)
+	_, err = exec("create index by_name_only on t (name);")
+	require.Nil(t, err)
+	assert.Equal(t, ErrConflict, tx.Commit())
+
+	for _, s := range []string{"drop index by_age on t;", "drop index by_name on t;", "drop index by_name_only on t;"} {
+		_, err = exec(s)
+		require.Nil(t, err)
+	}
+	_, err = exec("drop index by_age on t;")
+	assert.NotNil(t, err)
+	iter, err := db.Storage.Seek([]byte("@index_"))
+	require.Nil(t, err)
+	assert.True(t, !iter.Valid() || !bytes.HasPrefix(iter.Key(), []byte("@index_")))
+	_, err = exec("insert into t values (4, 'bob', 30);")
+	assert.Nil(t, err)
+}
+
+func TestUniqueIndexConcurrent(t *testing.T) {
+	db := NewDB(&MemKV{})
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	for _, s := range []string{
+		"create table u (id int64, email string, primary key (id));",
+		"create unique index ue on u (email);",
+	} {
+		_, err := db.ExecStmt(parseStmt(t, s))
+		require.Nil(t, err)
+	}
+
+	// neither transaction sees the other's row, but they write the same
+	// index entry, so only the first to commit wins
+	tx1, tx2 := db.Begin(), db.Begin()
+	_, err := tx1.ExecStmt(parseStmt(t, "insert into u values (1, 'x');"))
+	require.Nil(t, err)
+	_, err = tx2.ExecStmt(parseStmt(t, "insert into u values (2, 'x');"))
+	require.Nil(t, err)
+	require.Nil(t, tx1.Commit())
+	assert.Equal(t, ErrConflict, tx2.Commit())
+
+	r, err := db.ExecStmt(parseStmt(t, "select id from u where email = 'x';"))
+	require.Nil(t, err)
+	assert.Equal(t, []Row{{Cell{Type: TypeI64, I64: 1}}}, r.Values)
+
+	// moving a row to a value another transaction takes conflicts too
+	tx1, tx2 = db.Begin(), db.Begin()
+	_, err = tx1.ExecStmt(parseStmt(t, "update u set email = 'y' where id = 1;"))
+	require.Nil(t, err)
+	_, err = tx2.ExecStmt(parseStmt(t, "insert into u values (3, 'y');"))
+	require.Nil(t, err)
+	require.Nil(t, tx2.Commit())
+	assert.Equal(t, ErrConflict, tx1.Commit())
+
+	_, err = db.ExecStmt(parseStmt(t, "insert into u values (4, 'y');"))
+	assert.Equal(t, ErrDuplicate, err)
+	r, err = db.ExecStmt(parseStmt(t, "select id, email from u order by email;"))
+	require.Nil(t, err)
+	assert.Equal(t, []Row{
+		{Cell{Type: TypeI64, I64: 1}, Cell{Type: TypeStr, Str: []byte("x")}},
+		{Cell{Type: TypeI64, I64: 3}, Cell{Type: TypeStr, Str: []byte("y")}},
+	}, r.Values)
+}
+
+func TestIndexSnapshotSchema(t *testing.T) {
+	db := NewDB(&MemKV{})
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	for _, s := range []string{
+		"create table t (id int64, v int64, primary key (id));",
+		"insert into t values (1, 1);",
+		"insert into t values (2, 1);",
+	} {
+		_, err := db.ExecStmt(parseStmt(t, s))
+		require.Nil(t, err)
+	}
+	sess := db.Session()
+	_, err := sess.ExecStmt(parseStmt(t, "begin;"))
+	require.Nil(t, err)
+
+	// the index is committed after the transaction's snapshot, which has
+	// none of its entries, so the transaction must not use it
+	_, err = db.ExecStmt(parseStmt(t, "create index by_v on t (v);"))
+	require.Nil(t, err)
+	r, err := sess.ExecStmt(parseStmt(t, "select id from t where v = 1;"))
+	require.Nil(t, err)
+	assert.Len(t, r.Values, 2)
+	r, err = sess.ExecStmt(parseStmt(t, "explain select id from t where v = 1;"))
+	require.Nil(t, err)
+	assert.Contains(t, formatCell(&r.Values[len(r.Values)-1][0]), "FULL SCAN")
+	_, err = sess.ExecStmt(parseStmt(t, "rollback;"))
+	require.Nil(t, err)
+
+	r, err = db.ExecStmt(parseStmt(t, "explain select id from t where v = 1;"))
+	require.Nil(t, err)
+	assert.Contains(t, formatCell(&r.Values[len(r.Values)-1][0]), "INDEX")
+}
@@ -2,54 +2,156 @@ package kvdb
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io"
 	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Engine selects the structure KV keeps its data in.
+type Engine int
+
+const (
+	EngineLog   Engine = 0 // log replayed into sorted in-memory arrays
+	EngineBTree Engine = 1 // copy-on-write B+tree file with small entries, see btree.go
+	EngineLSM   Engine = 2 // memtable flushed to sorted table files, see lsm.go
 )
 
 type KV struct {
-	log Log
-	// * future note: currently all of the DB data needs to be loaded into memory ~ need to read up on ways to only have partial memory loaded
-	keys [][]byte
-	vals [][]byte
+	log    Log // also names the file for the other engines
+	Engine Engine
+	// SyncMode is how writes are made durable, see SyncAlways.
+	SyncMode SyncMode
+	// SyncBatched only, see Log.SyncInterval. Zero picks a default.
+	SyncInterval time.Duration
+	SyncBytes    int64
+	// CompactRatio triggers Compact automatically once the dead bytes in the
+	// log exceed this multiple of the live bytes. Zero disables it.
+	CompactRatio float64
+	// EngineLSM flushes the memtable to a table file once its entries
+	// take this many bytes. Zero picks a default.
+	MemtableSize int64
+	// EngineLog keeps all of the data in memory; EngineBTree only reads
+	// the pages it needs; for EngineLSM they are the memtable
+	keys      [][]byte
+	vals      [][]byte
+	liveBytes int64 // encoded size of the live entries
+	discarded int64 // bytes of torn tail dropped by the last Open
+	// compactErr is the failure of the last automatic compaction, which
+	// stops further ones until Compact succeeds
+	compactErr error
+	// shared is set while iterators may be reading keys/vals; the next
+	// write copies the slices instead of modifying them in place
+	shared atomic.Bool
+	// readers share mu; writers hold it exclusively while they log and
+	// update keys/vals, but wait for the fsync after releasing it
+	mu sync.RWMutex
+
+	tree *btree // EngineBTree
+	lsm  *lsm   // EngineLSM
+
+	// MVCC, see kv_snapshot.go
+	version uint64            // of the last commit
+	snaps   map[uint64]int    // open snapshots per version
+	keyVer  map[string]uint64 // last version that wrote a key
 }
 
+// KVIterator walks the keys in order. Iterators read a point-in-time
+// snapshot, so writes made after Seek returns are not seen. Close lets go
+// of the data the snapshot keeps alive.
 type KVIterator struct {
+	cur kvCursor
+}
+
+// kvCursor is the iterator of an engine behind KVIterator.
+type kvCursor interface {
+	Valid() bool
+	Key() []byte
+	Val() []byte
+	Next() error
+	Prev() error
+	Close()
+}
+
+// memIter iterates over the in-memory arrays of EngineLog.
+type memIter struct {
 	keys [][]byte
 	vals [][]byte
 	pos  int
 }
 
-type updateMode int
+type UpdateMode int
 
 const (
-	ModeUpsert updateMode = 0 // insert OR update
-	ModeInsert updateMode = 1 // insert NEW
-	ModeUpdate updateMode = 2 // update EXISTING
+	ModeUpsert UpdateMode = 0 // insert OR update
+	ModeInsert UpdateMode = 1 // insert NEW
+	ModeUpdate UpdateMode = 2 // update EXISTING
 )
 
+// updating reports whether SetEx writes val over the current value.
+func (mode UpdateMode) updating(old []byte, existed bool, val []byte) bool {
+	switch mode {
+	case ModeUpsert:
+		return !existed || !bytes.Equal(old, val)
+	case ModeInsert:
+		return !existed
+	case ModeUpdate:
+		return existed && !bytes.Equal(old, val)
+	default:
+		panic("NOT A VALID UPDATE MODE")
+	}
+}
+
 func (kv *KV) Open() error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.tree, kv.lsm = nil, nil
+	kv.log.SyncMode = kv.SyncMode
+	kv.log.SyncInterval, kv.log.SyncBytes = kv.SyncInterval, kv.SyncBytes
+	kv.snaps, kv.keyVer = map[uint64]int{}, map[string]uint64{}
+	// with MemoryFileName every engine is the in-memory arrays of EngineLog
+	memory := kv.log.inMemory()
+	if kv.Engine == EngineBTree && !memory {
+		kv.tree = &btree{}
+		return kv.tree.open(kv.log.FileName, kv.log.SyncMode)
+	}
+	if kv.Engine == EngineLSM && !memory {
+		kv.lsm = &lsm{base: kv.log.FileName, tableSize: kv.MemtableSize}
+		if kv.lsm.tableSize <= 0 {
+			kv.lsm.tableSize = defaultMemtableSize
+		}
+		if err := kv.lsm.open(); err != nil {
+			return err
+		}
+	}
 
 	if err := kv.log.Open(); err != nil {
+		if kv.lsm != nil {
+			kv.lsm.close()
+		}
 		return err
 	}
 	// neat trick to reuse existing memory
+	if kv.shared.Swap(false) {
+		kv.keys, kv.vals = nil, nil
+	}
 	kv.keys = kv.keys[:0]
 	kv.vals = kv.vals[:0]
 
-	entries := []Entry{}
-
-	for {
-		entry := Entry{}
-		eof, err := kv.log.Read(&entry)
+	entries, good, err := kv.replay()
+	if err != nil {
+		return err
+	}
 
-		if eof || err == ErrBadSum || err == io.ErrUnexpectedEOF {
-			break
-		}
-		if err != nil {
+	// drop the torn tail so new writes don't land behind garbage
+	kv.discarded = kv.log.size - good
+	if kv.discarded > 0 {
+		if err := kv.log.Truncate(good); err != nil {
 			return err
 		}
-
-		entries = append(entries, entry)
 	}
 
 	// groups together the same key operations
@@ -65,19 +167,121 @@ func (kv *KV) Open() error {
 			kv.vals = kv.vals[:n-1]
 		}
 
-		if !entry.deleted {
+		// the memtable keeps deletions to hide the key in older tables
+		if !entry.deleted || kv.lsm != nil {
 			kv.keys = append(kv.keys, entry.key)
 			kv.vals = append(kv.vals, entry.val)
 		}
 	}
+
+	kv.liveBytes = 0
+	for i := range kv.keys {
+		kv.liveBytes += entrySize(kv.keys[i], kv.vals[i])
+	}
+	kv.compactErr = nil
+	if kv.lsm != nil {
+		kv.startLSM()
+		return nil
+	}
+	kv.maybeCompact()
 	return nil
 }
 
-func (kv *KV) Close() error { return kv.log.Close() }
+// replay reads the log up to the first torn or corrupt entry and returns
+// the writes in log order along with the end offset of the intact prefix.
+// Batch entries only count once the batch's commit marker has been read.
+func (kv *KV) replay() (entries []Entry, good int64, err error) {
+	var batch []Entry
+	inBatch, batchSize := false, uint64(0)
+
+	for {
+		entry := Entry{}
+		eof, err := kv.log.Read(&entry)
+
+		if eof || err == ErrBadSum || err == ErrBadLength || err == io.ErrUnexpectedEOF {
+			return entries, good, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch entry.marker {
+		case markerBatchBegin:
+			if inBatch || len(entry.val) != lengthSize {
+				return entries, good, nil
+			}
+			inBatch, batchSize = true, binary.LittleEndian.Uint64(entry.val)
+			batch = batch[:0]
+			continue
+		case markerBatchCommit:
+			if !inBatch || uint64(len(batch)) != batchSize {
+				return entries, good, nil
+			}
+			entries = append(entries, batch...)
+			inBatch = false
+		default:
+			if inBatch {
+				batch = append(batch, entry)
+				continue
+			}
+			entries = append(entries, entry)
+		}
+
+		if good, err = kv.log.Offset(); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+func (kv *KV) Close() error {
+	kv.stopLSM()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.tree != nil {
+		return kv.tree.close()
+	}
+	if kv.lsm != nil {
+		kv.lsm.close()
+	}
+	return kv.log.Close()
+}
+
+// CompactErr reports why the last automatic compaction failed, or nil.
+// For EngineLSM this covers memtable flushes too. The writes that
+// triggered it are not affected: the old log is kept.
+func (kv *KV) CompactErr() error {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	return kv.compactErr
+}
+
+// Discarded reports how many bytes of corrupt or incomplete log tail the
+// last Open removed.
+func (kv *KV) Discarded() int64 {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	return kv.discarded
+}
 
 func (kv *KV) Get(key []byte) (val []byte, ok bool, err error) {
-	if idx, found := BinarySearchFunc(kv.keys, key, bytes.Compare); found {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	return kv.get(key)
+}
+
+// get looks the key up; the caller holds kv.mu.
+func (kv *KV) get(key []byte) (val []byte, ok bool, err error) {
+	if kv.tree != nil {
+		return kv.tree.get(key)
+	}
+	idx, found := BinarySearchFunc(kv.keys, key, bytes.Compare)
+	switch {
+	case found && kv.lsm != nil:
+		return kv.vals[idx], kv.vals[idx] != nil, nil
+	case found:
 		return kv.vals[idx], found, nil
+	case kv.lsm != nil:
+		return getLevels(kv.lsm.levels, key)
 	}
 	return nil, false, nil
 }
@@ -87,69 +291,220 @@ func (kv *KV) Set(key []byte, val []byte) (updated bool, err error) {
 }
 
 func (kv *KV) Del(key []byte) (deleted bool, err error) {
-	if idx, found := BinarySearchFunc(kv.keys, key, bytes.Compare); found {
-		if err = kv.log.Write(&Entry{key: key, deleted: true}); err != nil {
-			return false, err
+	kv.mu.Lock()
+	_, found, err := kv.get(key)
+	if err != nil || !found {
+		kv.mu.Unlock()
+		return false, err
+	}
+	seq, err := kv.commit([]Entry{{key: key, deleted: true}})
+	kv.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return true, kv.waitSync(seq)
+}
+
+func (kv *KV) SetEx(key []byte, val []byte, mode UpdateMode) (updating bool, err error) {
+	kv.mu.Lock()
+	old, existed, err := kv.get(key)
+	if err != nil {
+		kv.mu.Unlock()
+		return false, err
+	}
+	if !mode.updating(old, existed, val) {
+		kv.mu.Unlock()
+		return false, nil
+	}
+	seq, err := kv.commit([]Entry{{key: key, val: val, deleted: false}})
+	kv.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return true, kv.waitSync(seq)
+}
+
+// commit writes the entries as one atomic unit and applies them. The
+// caller holds kv.mu and passes the returned sequence number to waitSync
+// after releasing it, so that concurrent writers can share a group commit.
+func (kv *KV) commit(ents []Entry) (seq int64, err error) {
+	for i := range ents {
+		if len(ents[i].key) > maxEntryKey || len(ents[i].val) > maxEntryVal {
+			return 0, ErrTooLarge
 		}
-		kv.keys = slices.Delete(kv.keys, idx, idx+1)
-		kv.vals = slices.Delete(kv.vals, idx, idx+1)
-		return true, nil
 	}
-	return false, nil
+	kv.recordVersion(ents)
+	if kv.tree != nil {
+		return 0, kv.tree.write(ents)
+	}
+
+	data := []byte(nil)
+	if len(ents) == 1 {
+		data = ents[0].Encode()
+	} else {
+		data = encodeBatch(ents)
+	}
+	if seq, err = kv.log.append(data); err != nil {
+		return 0, err
+	}
+	for i := range ents {
+		kv.update(&ents[i])
+	}
+	if kv.lsm != nil {
+		kv.maybeFlush()
+	} else {
+		kv.maybeCompact()
+	}
+	return seq, nil
 }
 
-func (kv *KV) SetEx(key []byte, val []byte, mode updateMode) (updating bool, err error) {
-	idx, existed := BinarySearchFunc(kv.keys, key, bytes.Compare)
+func (kv *KV) waitSync(seq int64) error {
+	if kv.tree != nil {
+		return nil
+	}
+	return kv.log.waitSync(seq)
+}
 
-	switch mode {
-	case ModeUpsert:
-		updating = !existed || !bytes.Equal(kv.vals[idx], val)
-	case ModeInsert:
-		updating = !existed
-	case ModeUpdate:
-		updating = existed && !bytes.Equal(kv.vals[idx], val)
+// update applies a logged write to the in-memory keys. The LSM memtable
+// keeps a deletion as a nil value, so live values are never nil there.
+func (kv *KV) update(ent *Entry) {
+	idx, existed := BinarySearchFunc(kv.keys, ent.key, bytes.Compare)
+	keep := !ent.deleted || kv.lsm != nil
+	if (existed || keep) && kv.shared.Swap(false) {
+		kv.keys, kv.vals = slices.Clone(kv.keys), slices.Clone(kv.vals)
+	}
+	if existed {
+		kv.liveBytes -= entrySize(kv.keys[idx], kv.vals[idx])
+	}
+	val := ent.val
+	if kv.lsm != nil && !ent.deleted && val == nil {
+		val = []byte{}
+	}
+	switch {
+	case !keep && existed:
+		kv.keys = slices.Delete(kv.keys, idx, idx+1)
+		kv.vals = slices.Delete(kv.vals, idx, idx+1)
+	case !keep:
+	case existed:
+		kv.vals[idx] = val
 	default:
-		panic("NOT A VALID UPDATE MODE")
+		kv.keys = slices.Insert(kv.keys, idx, ent.key)
+		kv.vals = slices.Insert(kv.vals, idx, val)
 	}
-	if updating {
-		if err := kv.log.Write(&Entry{key: key, val: val, deleted: false}); err != nil {
-			return false, err
-		}
-		if existed {
-			kv.vals[idx] = val
-		} else {
-			kv.keys = slices.Insert(kv.keys, idx, key)
-			kv.vals = slices.Insert(kv.vals, idx, val)
+	if keep {
+		kv.liveBytes += entrySize(ent.key, val)
+	}
+}
+
+// Compact rewrites the log so it only holds the live key-value pairs. The
+// B+tree reuses freed pages instead and has nothing to compact. EngineLSM
+// flushes the memtable and merges levels until each is within its limit.
+func (kv *KV) Compact() error {
+	if kv.lsm != nil {
+		kv.mu.Lock()
+		err := kv.flush()
+		kv.mu.Unlock()
+		if err == nil {
+			err = kv.compactLevels()
 		}
+		kv.mu.Lock()
+		kv.compactErr = err
+		kv.mu.Unlock()
+		return err
 	}
-	return updating, nil
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.tree != nil {
+		return nil
+	}
+	kv.compactErr = kv.compact()
+	return kv.compactErr
 }
 
+func (kv *KV) compact() error {
+	ents := make([]Entry, len(kv.keys))
+	for i := range kv.keys {
+		ents[i] = Entry{key: kv.keys[i], val: kv.vals[i]}
+	}
+	return kv.log.Rewrite(ents)
+}
+
+// maybeCompact compacts once the dead bytes pass CompactRatio. A failure
+// leaves the old log in place and is kept for CompactErr rather than
+// failing the write that triggered it.
+func (kv *KV) maybeCompact() {
+	if kv.CompactRatio <= 0 || kv.compactErr != nil {
+		return
+	}
+	dead := kv.log.size - kv.liveBytes
+	if float64(dead) <= kv.CompactRatio*float64(kv.liveBytes) {
+		return
+	}
+	kv.compactErr = kv.compact()
+}
+
+// Seek positions an iterator at the first key >= key.
 func (kv *KV) Seek(key []byte) (*KVIterator, error) {
-	idx, _ := BinarySearchFunc(kv.keys,key,bytes.Compare)
-	return &KVIterator{keys: kv.keys, vals: kv.vals, pos: idx}, nil 
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	var cur kvCursor
+	var err error
+	switch {
+	case kv.tree != nil:
+		cur, err = kv.tree.seek(key)
+	case kv.lsm != nil:
+		view := kv.lsmView()
+		defer view.release()
+		cur, err = view.seek(key)
+	default:
+		kv.shared.Store(true)
+		idx, _ := BinarySearchFunc(kv.keys, key, bytes.Compare)
+		cur = &memIter{keys: kv.keys, vals: kv.vals, pos: idx}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &KVIterator{cur: cur}, nil
 }
 
-func (iter *KVIterator) Valid() bool {
+func (iter *KVIterator) Valid() bool { return iter.cur.Valid() }
+func (iter *KVIterator) Key() []byte { return iter.cur.Key() }
+func (iter *KVIterator) Val() []byte { return iter.cur.Val() }
+func (iter *KVIterator) Next() error { return iter.cur.Next() }
+func (iter *KVIterator) Prev() error { return iter.cur.Prev() }
+
+// Close releases the snapshot the iterator reads. It is safe to call more
+// than once; an iterator that is never closed is released when it is
+// garbage collected.
+func (iter *KVIterator) Close() { iter.cur.Close() }
+
+func (iter *memIter) Valid() bool {
 	return 0 <= iter.pos && iter.pos < len(iter.keys)
 }
 
-func (iter *KVIterator) Key() []byte {
+func (iter *memIter) Key() []byte {
 	return iter.keys[iter.pos]
 }
-func(iter *KVIterator) Val() []byte {
+func(iter *memIter) Val() []byte {
 	return iter.vals[iter.pos]
 }
 
-func(iter *KVIterator) Next() error {
+func(iter *memIter) Next() error {
 	if iter.pos < len(iter.keys) {
 		iter.pos += 1
 	}
 	return nil 
 }
-func(iter *KVIterator) Prev() error {
+func(iter *memIter) Prev() error {
 	if iter.pos >= 0 {
 		iter.pos -= 1
 	}
 	return nil 
-}
\ No newline at end of file
+}
+
+func (iter *memIter) Close() {}
+
+// deleted is only meaningful for the LSM memtable.
+func (iter *memIter) deleted() bool {
+	return iter.vals[iter.pos] == nil
+}
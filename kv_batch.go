@@ -0,0 +1,33 @@
+package kvdb
+
+// Batch collects writes that KV.Apply commits atomically.
+type Batch struct {
+	ents []Entry
+}
+
+func (kv *KV) NewBatch() *Batch { return &Batch{} }
+
+func (b *Batch) Set(key []byte, val []byte) {
+	b.ents = append(b.ents, Entry{key: key, val: val})
+}
+
+func (b *Batch) Del(key []byte) {
+	b.ents = append(b.ents, Entry{key: key, deleted: true})
+}
+
+func (b *Batch) Len() int { return len(b.ents) }
+
+// Apply writes every operation in the batch, in order, as one unit: after
+// a crash the log replays either all of them or none.
+func (kv *KV) Apply(b *Batch) error {
+	if len(b.ents) == 0 {
+		return nil
+	}
+	kv.mu.Lock()
+	seq, err := kv.commit(b.ents)
+	kv.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return kv.waitSync(seq)
+}
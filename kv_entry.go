@@ -11,28 +11,56 @@ type Entry struct {
 	key []byte
 	val []byte
 	deleted bool
+	marker entryMarker
 }
 
+// entryMarker tags the entries that frame an atomic batch in the log. The
+// begin marker carries the number of entries in the batch as its value.
+type entryMarker uint64
+
+const (
+	markerNone        entryMarker = 0
+	markerBatchBegin  entryMarker = 2
+	markerBatchCommit entryMarker = 3
+)
+
 const (
 	lengthSize = 8  
 	entryHeaderSize = 4 * lengthSize
 )
-var ErrBadSum = errors.New("bad checksum")
+const (
+	// the largest key and value the log takes; a header claiming more is
+	// corrupt
+	maxEntryKey = 1 << 16
+	maxEntryVal = 1 << 30
+)
+
+var (
+	ErrBadSum    = errors.New("bad checksum")
+	ErrBadLength = errors.New("entry length out of range")
+)
+
+// entrySize is the encoded size of a key-value pair in the log.
+func entrySize(key []byte, val []byte) int64 {
+	return int64(entryHeaderSize + len(key) + len(val))
+}
 var tab *crc64.Table = crc64.MakeTable(crc64.ISO)
 
 /* 
 All integer fields are encoded using Little Endian.
 
 Serialization Format (binary encoded)
-| key size | val size | checksum | deleted  | key data | val data |
+| key size | val size | checksum | flags    | key data | val data |
 | 8 bytes  | 8 bytes  | 8 bytes  | 8 bytes  | ...    |   ...    |
+
+flags is 1 for a deleted key, otherwise the batch marker (0 for a plain write).
 */
 func (ent *Entry) Encode() []byte {
 	size := entryHeaderSize + len(ent.key) + len(ent.val)
 	data := make([]byte, size)
-	var isDeleted uint64
+	flags := uint64(ent.marker)
 	if ent.deleted {
-		isDeleted = 1
+		flags = 1
 	}
 	
 	var hash uint64 = 0
@@ -41,15 +69,26 @@ func (ent *Entry) Encode() []byte {
 	binary.LittleEndian.PutUint64(data[:lengthSize],uint64(len(ent.key)))
 	binary.LittleEndian.PutUint64(data[lengthSize:2*lengthSize],uint64(len(ent.val)))
 	binary.LittleEndian.PutUint64(data[2*lengthSize:3*lengthSize],hash)
-	binary.LittleEndian.PutUint64(data[3*lengthSize:entryHeaderSize],isDeleted)
+	binary.LittleEndian.PutUint64(data[3*lengthSize:entryHeaderSize],flags)
 	copy(data[entryHeaderSize:],ent.key)
 	copy(data[entryHeaderSize+len(ent.key):],ent.val)
 	
 	return data
 }
 
+// Decode reads one entry. The lengths in the header are checked before
+// anything is allocated: past the limits above or, when r reports its
+// Len, past the bytes left they give ErrBadLength.
 func (ent *Entry) Decode(r io.Reader) error {
-	
+	left := int64(-1)
+	if lr, ok := r.(interface{ Len() int }); ok {
+		left = int64(lr.Len())
+	}
+	return ent.decode(r, left)
+}
+
+// decode is Decode with left bytes remaining in r, -1 if unknown.
+func (ent *Entry) decode(r io.Reader, left int64) error {
 	size := make([]byte,entryHeaderSize)
 
 	if _, err := io.ReadFull(r,size); err != nil { return err }
@@ -60,15 +99,21 @@ func (ent *Entry) Decode(r io.Reader) error {
 
 	logHash := binary.LittleEndian.Uint64(size[2*lengthSize:3*lengthSize])
 	
-	deletedInt := binary.LittleEndian.Uint64(size[3*lengthSize:])
+	flags := binary.LittleEndian.Uint64(size[3*lengthSize:])
+
+	if keyLength > maxEntryKey || valueLength > maxEntryVal ||
+		(left >= 0 && int64(keyLength+valueLength) > left-entryHeaderSize) {
+		return ErrBadLength
+	}
 
 	data := make([]byte,keyLength+valueLength)
 
 	if _, err := io.ReadFull(r,data); err != nil { return err }
 
 	ent.key = data[:keyLength]
-	ent.deleted = deletedInt == 1
+	ent.deleted = flags == 1
 	if !ent.deleted {
+		ent.marker = entryMarker(flags)
 		ent.val = data[keyLength:]
 	}
 
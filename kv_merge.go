@@ -0,0 +1,115 @@
+package kvdb
+
+import "bytes"
+
+// rawIter is an iterator that also reports deletions, so that a newer
+// source can hide the key in an older one.
+type rawIter interface {
+	kvCursor
+	deleted() bool
+}
+
+// mergeIter merges sorted sources into one ordered view in either
+// direction. Sources are ordered newest first: when several hold the same
+// key, the first one wins. Deleted keys are skipped unless tombstones is
+// set, in which case they are returned with deleted() true.
+//
+// Going forward every source sits on its first key >= the current key;
+// going backward on its last key <= the current key. Turning around moves
+// every source one step past the current key.
+type mergeIter struct {
+	srcs       []rawIter
+	cur        int // winning source, -1 when out of range
+	fwd        bool
+	tombstones bool
+}
+
+// newMergeIter expects every source positioned at its first key >= the
+// seek key.
+func newMergeIter(srcs []rawIter, tombstones bool) (*mergeIter, error) {
+	iter := &mergeIter{srcs: srcs, fwd: true, tombstones: tombstones}
+	return iter, iter.settle()
+}
+
+// pick finds the source holding the next key in the current direction.
+func (iter *mergeIter) pick() {
+	iter.cur = -1
+	for i, src := range iter.srcs {
+		if !src.Valid() {
+			continue
+		}
+		if iter.cur < 0 {
+			iter.cur = i
+			continue
+		}
+		cmp := bytes.Compare(src.Key(), iter.srcs[iter.cur].Key())
+		if (iter.fwd && cmp < 0) || (!iter.fwd && cmp > 0) {
+			iter.cur = i
+		}
+	}
+}
+
+// settle picks the current key, skipping deleted ones.
+func (iter *mergeIter) settle() error {
+	for iter.pick(); iter.cur >= 0 && !iter.tombstones && iter.srcs[iter.cur].deleted(); iter.pick() {
+		if err := iter.step(iter.srcs[iter.cur].Key()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// step moves the sources past key in the current direction. A nil key
+// only moves the sources that are out of range, which is where they all
+// are when the merged iterator is.
+func (iter *mergeIter) step(key []byte) error {
+	for _, src := range iter.srcs {
+		move := !src.Valid()
+		if !move && key != nil {
+			cmp := bytes.Compare(src.Key(), key)
+			move = (iter.fwd && cmp <= 0) || (!iter.fwd && cmp >= 0)
+		}
+		if !move {
+			continue
+		}
+		var err error
+		if iter.fwd {
+			err = src.Next()
+		} else {
+			err = src.Prev()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (iter *mergeIter) Valid() bool   { return iter.cur >= 0 }
+func (iter *mergeIter) Key() []byte   { return iter.srcs[iter.cur].Key() }
+func (iter *mergeIter) Val() []byte   { return iter.srcs[iter.cur].Val() }
+func (iter *mergeIter) deleted() bool { return iter.srcs[iter.cur].deleted() }
+
+// Close closes the sources.
+func (iter *mergeIter) Close() {
+	for _, src := range iter.srcs {
+		src.Close()
+	}
+}
+
+func (iter *mergeIter) Next() error { return iter.move(true) }
+func (iter *mergeIter) Prev() error { return iter.move(false) }
+
+func (iter *mergeIter) move(fwd bool) error {
+	var key []byte
+	if iter.cur >= 0 {
+		key = iter.Key()
+	} else if iter.fwd == fwd {
+		return nil // already past the end in this direction
+	}
+	iter.fwd = fwd
+	if err := iter.step(key); err != nil {
+		return err
+	}
+	return iter.settle()
+}
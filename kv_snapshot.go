@@ -0,0 +1,208 @@
+package kvdb
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"sync"
+)
+
+/*
+Every commit gets the next version number. A Snapshot of a KV reads the data as of
+one version: each engine already writes copy-on-write, so the view only
+has to keep the old state alive. That is the memtable slices for the log
+and LSM engines, the SSTables of the LSM engine by reference count, and the
+root of the B+tree, whose pages are not reused while the version is pinned.
+The old state is garbage collected once the last snapshot using it goes.
+
+Snapshot.Apply commits a batch on behalf of a transaction that read from
+the snapshot. It fails with ErrConflict if another commit since the
+snapshot's version wrote one of the keys (first committer wins). To check
+that, KV remembers the last version that wrote each key while any snapshot
+is open, and forgets the versions no open snapshot is older than.
+*/
+
+var (
+	ErrConflict = errors.New("write conflict with a concurrent transaction")
+	ErrReleased = errors.New("snapshot is released")
+)
+
+// kvView is the frozen state of the data a Snapshot reads.
+type kvView interface {
+	get(key []byte) ([]byte, bool, error)
+	seek(key []byte) (kvCursor, error)
+	release()
+}
+
+// kvSnapshot is the Snapshot of a KV.
+type kvSnapshot struct {
+	kv      *KV
+	view    kvView
+	version uint64
+	mu      sync.RWMutex // guards view against Release
+}
+
+// Snapshot opens a consistent read-only view of the current version. Call
+// Release when done; the snapshot keeps old data alive until then.
+func (kv *KV) Snapshot() Snapshot {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	snap := &kvSnapshot{kv: kv, version: kv.version, view: kv.view()}
+	kv.snaps[snap.version]++
+	runtime.SetFinalizer(snap, (*kvSnapshot).Release)
+	return snap
+}
+
+// view freezes the current state; the caller holds kv.mu.
+func (kv *KV) view() kvView {
+	switch {
+	case kv.tree != nil:
+		kv.tree.pin(kv.tree.version)
+		return &btreeView{tree: kv.tree, root: kv.tree.root, version: kv.tree.version}
+	case kv.lsm != nil:
+		return kv.lsmView()
+	default:
+		kv.shared.Store(true)
+		return &memView{keys: kv.keys, vals: kv.vals}
+	}
+}
+
+func (snap *kvSnapshot) Get(key []byte) (val []byte, ok bool, err error) {
+	snap.mu.RLock()
+	defer snap.mu.RUnlock()
+	if snap.view == nil {
+		return nil, false, ErrReleased
+	}
+	return snap.view.get(key)
+}
+
+// Seek positions an iterator at the first key >= key of the snapshot. The
+// iterator stays valid after Release until it is closed.
+func (snap *kvSnapshot) Seek(key []byte) (*KVIterator, error) {
+	snap.mu.RLock()
+	defer snap.mu.RUnlock()
+	if snap.view == nil {
+		return nil, ErrReleased
+	}
+	cur, err := snap.view.seek(key)
+	if err != nil {
+		return nil, err
+	}
+	return &KVIterator{cur: cur}, nil
+}
+
+// Apply commits the batch unless a key in it was written after the
+// snapshot was taken.
+func (snap *kvSnapshot) Apply(b *Batch) error {
+	snap.mu.RLock()
+	defer snap.mu.RUnlock()
+	if snap.view == nil {
+		return ErrReleased
+	}
+	kv := snap.kv
+	kv.mu.Lock()
+	for i := range b.ents {
+		if kv.keyVer[string(b.ents[i].key)] > snap.version {
+			kv.mu.Unlock()
+			return ErrConflict
+		}
+	}
+	if len(b.ents) == 0 {
+		kv.mu.Unlock()
+		return nil
+	}
+	seq, err := kv.commit(b.ents)
+	kv.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return kv.waitSync(seq)
+}
+
+func (snap *kvSnapshot) Release() {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	if snap.view == nil {
+		return
+	}
+	snap.view.release()
+	snap.view = nil
+	runtime.SetFinalizer(snap, nil)
+
+	kv := snap.kv
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.snaps[snap.version]--; kv.snaps[snap.version] == 0 {
+		delete(kv.snaps, snap.version)
+	}
+	kv.forgetVersions()
+}
+
+// recordVersion notes a commit for the conflict checks; the caller holds
+// kv.mu.
+func (kv *KV) recordVersion(ents []Entry) {
+	kv.version++
+	if len(kv.snaps) == 0 {
+		return
+	}
+	for i := range ents {
+		kv.keyVer[string(ents[i].key)] = kv.version
+	}
+}
+
+// forgetVersions drops the key versions that no open snapshot can conflict
+// with; the caller holds kv.mu.
+func (kv *KV) forgetVersions() {
+	if len(kv.snaps) == 0 {
+		clear(kv.keyVer)
+		return
+	}
+	oldest, first := uint64(0), true
+	for version := range kv.snaps {
+		if first || version < oldest {
+			oldest, first = version, false
+		}
+	}
+	for key, version := range kv.keyVer {
+		if version <= oldest {
+			delete(kv.keyVer, key)
+		}
+	}
+}
+
+// memView is a snapshot of the in-memory arrays.
+type memView struct {
+	keys [][]byte
+	vals [][]byte
+}
+
+func (view *memView) get(key []byte) ([]byte, bool, error) {
+	if idx, found := BinarySearchFunc(view.keys, key, bytes.Compare); found {
+		return view.vals[idx], true, nil
+	}
+	return nil, false, nil
+}
+
+func (view *memView) seek(key []byte) (kvCursor, error) {
+	idx, _ := BinarySearchFunc(view.keys, key, bytes.Compare)
+	return &memIter{keys: view.keys, vals: view.vals, pos: idx}, nil
+}
+
+func (view *memView) release() {}
+
+// btreeView is a pinned version of the B+tree.
+type btreeView struct {
+	tree    *btree
+	root    uint64
+	version uint64
+}
+
+func (view *btreeView) get(key []byte) ([]byte, bool, error) {
+	return view.tree.getAt(view.root, key)
+}
+
+func (view *btreeView) seek(key []byte) (kvCursor, error) {
+	return view.tree.seekAt(view.root, view.version, key)
+}
+
+func (view *btreeView) release() { view.tree.unpin(view.version) }
@@ -0,0 +1,104 @@
+package kvdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVSnapshotEngines(t *testing.T) {
+	for _, engine := range []Engine{EngineLog, EngineBTree, EngineLSM} {
+		removeLSM()
+		kv := &KV{Engine: engine, MemtableSize: 1024}
+		// iterators drop their table references in finalizers, after the
+		// test; a file name of its own keeps them off other tests' tables
+		kv.log.FileName = ".test_db_snap"
+		kv.SyncMode = SyncNone
+		require.Nil(t, kv.Open())
+		testKVSnapshot(t, kv)
+		require.Nil(t, kv.Close())
+	}
+	removeLSM()
+}
+
+func testKVSnapshot(t *testing.T, kv *KV) {
+	key := func(i int) []byte { return []byte(fmt.Sprintf("k%03d", i)) }
+	for i := 0; i < 100; i++ {
+		_, err := kv.Set(key(i), []byte("old"))
+		require.Nil(t, err)
+	}
+	snap := kv.Snapshot()
+	for i := 0; i < 100; i++ {
+		var err error
+		if i%2 == 0 {
+			_, err = kv.Set(key(i), []byte("new"))
+		} else {
+			_, err = kv.Del(key(i))
+		}
+		require.Nil(t, err)
+	}
+	// enough for the LSM engine to flush and compact underneath
+	require.Nil(t, kv.Compact())
+
+	for i := 0; i < 100; i++ {
+		val, ok, err := snap.Get(key(i))
+		require.True(t, ok && err == nil)
+		assert.Equal(t, "old", string(val))
+	}
+	iter, err := snap.Seek(nil)
+	require.Nil(t, err)
+	count := 0
+	for ; iter.Valid(); require.Nil(t, iter.Next()) {
+		assert.Equal(t, "old", string(iter.Val()))
+		count++
+	}
+	assert.Equal(t, 100, count)
+	_, ok, err := kv.Get(key(1))
+	assert.True(t, !ok && err == nil)
+
+	// first committer wins
+	b := kv.NewBatch()
+	b.Set(key(0), []byte("tx"))
+	assert.Equal(t, ErrConflict, snap.Apply(b))
+	b = kv.NewBatch()
+	b.Set(key(100), []byte("tx"))
+	assert.Nil(t, snap.Apply(b))
+
+	snap.Release()
+	assert.Empty(t, kv.keyVer)
+	_, _, err = snap.Get(key(0))
+	assert.Equal(t, ErrReleased, err)
+	assert.Equal(t, ErrReleased, snap.Apply(b))
+
+	// without snapshots no versions are kept
+	_, err = kv.Set(key(0), []byte("x"))
+	require.Nil(t, err)
+	assert.Empty(t, kv.keyVer)
+}
+
+func TestKVSnapshotForget(t *testing.T) {
+	kv := &KV{}
+	kv.log.FileName = MemoryFileName
+	require.Nil(t, kv.Open())
+	defer kv.Close()
+
+	old := kv.Snapshot()
+	_, err := kv.Set([]byte("a"), []byte("1"))
+	require.Nil(t, err)
+	young := kv.Snapshot()
+	_, err = kv.Set([]byte("b"), []byte("1"))
+	require.Nil(t, err)
+	assert.Len(t, kv.keyVer, 2)
+
+	// only the write after the young snapshot can still conflict
+	old.Release()
+	assert.Len(t, kv.keyVer, 1)
+	b := kv.NewBatch()
+	b.Set([]byte("a"), []byte("2"))
+	assert.Nil(t, young.Apply(b))
+	young.Release()
+	assert.Empty(t, kv.keyVer)
+	assert.Empty(t, kv.snaps)
+}
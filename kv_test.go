@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -214,4 +215,334 @@ func TestKVSeek(t *testing.T) {
 	iter, err = kv.Seek([]byte("h"))
 	require.Nil(t, err)
 	assert.False(t, iter.Valid())
-}
\ No newline at end of file
+}
+
+func TestKVCompact(t *testing.T) {
+	kv := KV{}
+	kv.log.FileName = ".test_db"
+	defer os.Remove(kv.log.FileName)
+
+	os.Remove(kv.log.FileName)
+	err := kv.Open()
+	require.Nil(t, err)
+	defer kv.Close()
+
+	for i := 0; i < 10; i++ {
+		_, err = kv.Set([]byte("k1"), []byte{byte(i)})
+		require.Nil(t, err)
+	}
+	_, err = kv.Set([]byte("k2"), []byte("v2"))
+	require.Nil(t, err)
+	_, err = kv.Set([]byte("k3"), []byte("v3"))
+	require.Nil(t, err)
+	_, err = kv.Del([]byte("k3"))
+	require.Nil(t, err)
+
+	err = kv.Compact()
+	require.Nil(t, err)
+	st, err := os.Stat(kv.log.FileName)
+	require.Nil(t, err)
+	assert.Equal(t, entrySize([]byte("k1"), []byte{9})+entrySize([]byte("k2"), []byte("v2")), st.Size())
+
+	// writes continue on the compacted file
+	_, err = kv.Set([]byte("k4"), []byte("v4"))
+	require.Nil(t, err)
+
+	kv.Close()
+	err = kv.Open()
+	require.Nil(t, err)
+	val, ok, err := kv.Get([]byte("k1"))
+	assert.True(t, ok && err == nil && bytes.Equal(val, []byte{9}))
+	val, ok, err = kv.Get([]byte("k2"))
+	assert.True(t, ok && err == nil && string(val) == "v2")
+	_, ok, err = kv.Get([]byte("k3"))
+	assert.True(t, !ok && err == nil)
+	val, ok, err = kv.Get([]byte("k4"))
+	assert.True(t, ok && err == nil && string(val) == "v4")
+}
+
+func TestKVAutoCompact(t *testing.T) {
+	kv := KV{CompactRatio: 1}
+	kv.log.FileName = ".test_db"
+	defer os.Remove(kv.log.FileName)
+
+	os.Remove(kv.log.FileName)
+	err := kv.Open()
+	require.Nil(t, err)
+	defer kv.Close()
+
+	for i := 0; i < 100; i++ {
+		_, err = kv.Set([]byte("k"), []byte{byte(i)})
+		require.Nil(t, err)
+		st, err := os.Stat(kv.log.FileName)
+		require.Nil(t, err)
+		assert.LessOrEqual(t, st.Size(), 2*entrySize([]byte("k"), []byte{0}))
+	}
+
+	kv.Close()
+	err = kv.Open()
+	require.Nil(t, err)
+	val, ok, err := kv.Get([]byte("k"))
+	assert.True(t, ok && err == nil && bytes.Equal(val, []byte{99}))
+}
+
+func TestKVAutoCompactFailure(t *testing.T) {
+	kv := KV{CompactRatio: 1}
+	kv.log.FileName = ".test_db"
+	defer os.Remove(kv.log.FileName)
+
+	os.Remove(kv.log.FileName)
+	err := kv.Open()
+	require.Nil(t, err)
+	defer kv.Close()
+
+	// the compacted log cannot be created
+	require.Nil(t, os.Mkdir(kv.log.FileName+".compact", 0o755))
+	defer os.Remove(kv.log.FileName + ".compact")
+	for i := 0; i < 10; i++ {
+		_, err = kv.Set([]byte("k"), []byte{byte(i)})
+		require.Nil(t, err)
+	}
+	assert.NotNil(t, kv.CompactErr())
+
+	kv.Close()
+	err = kv.Open()
+	require.Nil(t, err)
+	assert.NotNil(t, kv.CompactErr())
+	val, ok, err := kv.Get([]byte("k"))
+	assert.True(t, ok && err == nil && bytes.Equal(val, []byte{9}))
+
+	os.Remove(kv.log.FileName + ".compact")
+	require.Nil(t, kv.Compact())
+	assert.Nil(t, kv.CompactErr())
+}
+
+func TestKVTruncateTail(t *testing.T) {
+	kv := KV{}
+	kv.log.FileName = ".test_db"
+	defer os.Remove(kv.log.FileName)
+
+	os.Remove(kv.log.FileName)
+	err := kv.Open()
+	require.Nil(t, err)
+	_, err = kv.Set([]byte("k1"), []byte("v1"))
+	require.Nil(t, err)
+	kv.Close()
+
+	// simulate a torn write
+	fp, _ := os.OpenFile(kv.log.FileName, os.O_RDWR|os.O_APPEND, 0o644)
+	fp.Write([]byte{0x2, 0x0, 0x0})
+	fp.Close()
+
+	err = kv.Open()
+	require.Nil(t, err)
+	assert.Equal(t, int64(3), kv.Discarded())
+	st, _ := os.Stat(kv.log.FileName)
+	assert.Equal(t, entrySize([]byte("k1"), []byte("v1")), st.Size())
+
+	// writes after recovery must survive the next replay
+	_, err = kv.Set([]byte("k2"), []byte("v2"))
+	require.Nil(t, err)
+	kv.Close()
+
+	err = kv.Open()
+	require.Nil(t, err)
+	defer kv.Close()
+	assert.Equal(t, int64(0), kv.Discarded())
+	val, ok, err := kv.Get([]byte("k1"))
+	assert.True(t, string(val) == "v1" && ok && err == nil)
+	val, ok, err = kv.Get([]byte("k2"))
+	assert.True(t, string(val) == "v2" && ok && err == nil)
+}
+
+func TestKVBadLength(t *testing.T) {
+	kv := KV{}
+	kv.log.FileName = ".test_db"
+	defer os.Remove(kv.log.FileName)
+
+	os.Remove(kv.log.FileName)
+	err := kv.Open()
+	require.Nil(t, err)
+	_, err = kv.Set([]byte("k1"), []byte("v1"))
+	require.Nil(t, err)
+	kv.Close()
+
+	// a torn header whose lengths are garbage must not be allocated
+	header := make([]byte, entryHeaderSize)
+	for i := range 2 * lengthSize {
+		header[i] = 0xff
+	}
+	fp, _ := os.OpenFile(kv.log.FileName, os.O_RDWR|os.O_APPEND, 0o644)
+	fp.Write(header)
+	fp.Close()
+
+	err = kv.Open()
+	require.Nil(t, err)
+	defer kv.Close()
+	assert.Equal(t, int64(entryHeaderSize), kv.Discarded())
+	val, ok, err := kv.Get([]byte("k1"))
+	assert.True(t, string(val) == "v1" && ok && err == nil)
+
+	// lengths within the limits but past the end of the data
+	ent := Entry{key: []byte("k1"), val: []byte("v1")}
+	data := ent.Encode()
+	assert.Equal(t, ErrBadLength, (&Entry{}).Decode(bytes.NewReader(data[:len(data)-1])))
+}
+
+func TestKVBatch(t *testing.T) {
+	kv := KV{}
+	kv.log.FileName = ".test_db"
+	defer os.Remove(kv.log.FileName)
+
+	os.Remove(kv.log.FileName)
+	err := kv.Open()
+	require.Nil(t, err)
+
+	_, err = kv.Set([]byte("k1"), []byte("v1"))
+	require.Nil(t, err)
+
+	batch := kv.NewBatch()
+	batch.Set([]byte("k2"), []byte("v2"))
+	batch.Set([]byte("k3"), []byte("v3"))
+	batch.Del([]byte("k1"))
+	batch.Set([]byte("k3"), []byte("v33"))
+	err = kv.Apply(batch)
+	require.Nil(t, err)
+
+	check := func() {
+		_, ok, err := kv.Get([]byte("k1"))
+		assert.True(t, !ok && err == nil)
+		val, ok, err := kv.Get([]byte("k2"))
+		assert.True(t, string(val) == "v2" && ok && err == nil)
+		val, ok, err = kv.Get([]byte("k3"))
+		assert.True(t, string(val) == "v33" && ok && err == nil)
+	}
+	check()
+	kv.Close()
+	err = kv.Open()
+	require.Nil(t, err)
+	check()
+
+	// a batch missing its commit marker is dropped as a whole
+	batch = kv.NewBatch()
+	batch.Set([]byte("k4"), []byte("v4"))
+	batch.Del([]byte("k2"))
+	err = kv.Apply(batch)
+	require.Nil(t, err)
+	kv.Close()
+
+	fp, _ := os.OpenFile(kv.log.FileName, os.O_RDWR, 0o644)
+	st, _ := fp.Stat()
+	fp.Truncate(st.Size() - entryHeaderSize)
+	fp.Close()
+
+	err = kv.Open()
+	require.Nil(t, err)
+	defer kv.Close()
+	batchSize := entrySize(nil, make([]byte, lengthSize)) + entryHeaderSize +
+		entrySize([]byte("k4"), []byte("v4")) + entrySize([]byte("k2"), nil)
+	assert.Equal(t, batchSize-entryHeaderSize, kv.Discarded())
+	check()
+	_, ok, err := kv.Get([]byte("k4"))
+	assert.True(t, !ok && err == nil)
+}
+
+func TestKVSeekSnapshot(t *testing.T) {
+	kv := KV{}
+	kv.log.FileName = ".test_db"
+	defer os.Remove(kv.log.FileName)
+
+	os.Remove(kv.log.FileName)
+	err := kv.Open()
+	require.Nil(t, err)
+	defer kv.Close()
+
+	for _, k := range []string{"b", "d", "f"} {
+		_, err = kv.Set([]byte(k), []byte(k))
+		require.Nil(t, err)
+	}
+
+	iter, err := kv.Seek([]byte("a"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("b"), iter.Key())
+
+	// none of these may shift the iterator
+	_, err = kv.Set([]byte("a"), []byte("a"))
+	require.Nil(t, err)
+	_, err = kv.Set([]byte("c"), []byte("c"))
+	require.Nil(t, err)
+	_, err = kv.Del([]byte("d"))
+	require.Nil(t, err)
+	_, err = kv.Set([]byte("f"), []byte("ff"))
+	require.Nil(t, err)
+
+	got := []string{}
+	for ; iter.Valid(); iter.Next() {
+		got = append(got, string(iter.Key())+"="+string(iter.Val()))
+	}
+	assert.Equal(t, []string{"b=b", "d=d", "f=f"}, got)
+
+	iter, err = kv.Seek([]byte("a"))
+	require.Nil(t, err)
+	got = []string{}
+	for ; iter.Valid(); iter.Next() {
+		got = append(got, string(iter.Key())+"="+string(iter.Val()))
+	}
+	assert.Equal(t, []string{"a=a", "b=b", "c=c", "f=ff"}, got)
+}
+
+func TestKVInMemory(t *testing.T) {
+	kv := KV{Engine: EngineBTree, CompactRatio: 1}
+	kv.log.FileName = MemoryFileName
+	kv.SyncMode = SyncBatched
+	require.Nil(t, kv.Open())
+
+	updated, err := kv.SetEx([]byte("k1"), []byte("v1"), ModeUpdate)
+	assert.True(t, !updated && err == nil)
+	updated, err = kv.SetEx([]byte("k1"), []byte("v1"), ModeInsert)
+	assert.True(t, updated && err == nil)
+	for i := 0; i < 10; i++ {
+		_, err = kv.Set([]byte("k2"), []byte{byte(i)})
+		require.Nil(t, err)
+	}
+	batch := kv.NewBatch()
+	batch.Set([]byte("k3"), []byte("v3"))
+	batch.Del([]byte("k1"))
+	require.Nil(t, kv.Apply(batch))
+	require.Nil(t, kv.Compact())
+
+	iter, err := kv.Seek(nil)
+	require.Nil(t, err)
+	got := []string{}
+	for ; iter.Valid(); iter.Next() {
+		got = append(got, string(iter.Key()))
+	}
+	assert.Equal(t, []string{"k2", "k3"}, got)
+
+	_, err = os.Stat(MemoryFileName)
+	assert.True(t, os.IsNotExist(err))
+
+	// nothing survives a reopen
+	require.Nil(t, kv.Close())
+	require.Nil(t, kv.Open())
+	defer kv.Close()
+	_, ok, err := kv.Get([]byte("k3"))
+	assert.True(t, !ok && err == nil)
+}
+
+func TestKVSyncOptions(t *testing.T) {
+	kv := KV{SyncMode: SyncBatched, SyncInterval: 50 * time.Millisecond, SyncBytes: 1 << 10}
+	kv.log.FileName = ".test_db"
+	defer os.Remove(kv.log.FileName)
+
+	os.Remove(kv.log.FileName)
+	require.Nil(t, kv.Open())
+	defer kv.Close()
+	assert.Equal(t, int64(1<<10), kv.log.SyncBytes)
+
+	// a lone writer waits out the whole group commit window
+	start := time.Now()
+	_, err := kv.Set([]byte("k"), []byte("v"))
+	require.Nil(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
@@ -1,31 +1,269 @@
 package kvdb
 
 import (
+	"bufio"
+	"encoding/binary"
 	"io"
 	"os"
+	"sync"
+	"time"
 )
 
+type SyncMode int
+
+const (
+	SyncAlways  SyncMode = 0 // fsync before every write returns
+	SyncBatched SyncMode = 1 // group commit: concurrent writes share one fsync
+	SyncNone    SyncMode = 2 // leave flushing to the OS
+)
+
+const (
+	defaultSyncInterval = 2 * time.Millisecond
+	defaultSyncBytes    = 1 << 20
+)
+
+// MemoryFileName keeps the log in memory: nothing is written and nothing
+// survives Close.
+const MemoryFileName = ":memory:"
+
 type Log struct {
 	FileName string
-	fp       *os.File
+	SyncMode SyncMode
+	// SyncBatched only: how long a group commit waits for more writers and
+	// how many pending bytes force the fsync early. Zero picks a default.
+	SyncInterval time.Duration
+	SyncBytes    int64
+
+	fp   *os.File
+	size int64 // bytes in the file, live or dead
+
+	mu       sync.Mutex
+	synced   *sync.Cond // signalled when syncedTo advances
+	appended int64      // total bytes ever written, never reset
+	syncedTo int64      // prefix of appended known to be durable
+	syncErr  error
+	syncs    int64 // fsyncs made for writes
+	kick     chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
 }
 
+func (log *Log) inMemory() bool { return log.FileName == MemoryFileName }
+
 func (log *Log) Open() (err error) {
-	log.fp, err = createFileSync(log.FileName)
-	return err
+	log.synced = sync.NewCond(&log.mu)
+	log.syncErr = nil
+	if log.inMemory() {
+		log.size = 0
+		return nil
+	}
+	if log.fp, err = createFileSync(log.FileName); err != nil {
+		return err
+	}
+	st, err := log.fp.Stat()
+	if err != nil {
+		_ = log.fp.Close()
+		return err
+	}
+	log.size = st.Size()
+	if log.SyncMode == SyncBatched {
+		log.kick = make(chan struct{}, 1)
+		log.done = make(chan struct{})
+		log.stopped = make(chan struct{})
+		go log.groupCommit()
+	}
+	return nil
 }
 
 func (log *Log) Close() error {
+	if log.inMemory() {
+		return nil
+	}
+	if log.SyncMode == SyncBatched {
+		close(log.done)
+		<-log.stopped
+	}
 	return log.fp.Close()
 }
 
+// Write appends the entry and, depending on SyncMode, waits until it is
+// durable.
 func (log *Log) Write(ent *Entry) error {
-	_, err := log.fp.Write(ent.Encode())
-	return err
+	seq, err := log.append(ent.Encode())
+	if err != nil {
+		return err
+	}
+	return log.waitSync(seq)
+}
+
+// encodeBatch frames the entries with batch markers. Appended in a single
+// write, replay either sees all of them or none.
+func encodeBatch(ents []Entry) []byte {
+	count := binary.LittleEndian.AppendUint64(nil, uint64(len(ents)))
+	begin := Entry{val: count, marker: markerBatchBegin}
+	data := begin.Encode()
+	for i := range ents {
+		data = append(data, ents[i].Encode()...)
+	}
+	commit := Entry{marker: markerBatchCommit}
+	return append(data, commit.Encode()...)
+}
+
+// append writes data to the file and returns the sequence number to pass
+// to waitSync.
+func (log *Log) append(data []byte) (seq int64, err error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	if log.inMemory() {
+		log.appended += int64(len(data))
+		log.syncedTo = log.appended
+		return log.appended, nil
+	}
+	n, err := log.fp.Write(data)
+	log.size += int64(n)
+	log.appended += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	if log.SyncMode == SyncAlways {
+		if err = log.fp.Sync(); err != nil {
+			return 0, err
+		}
+		log.syncs++
+		log.syncedTo = log.appended
+	}
+	return log.appended, nil
+}
+
+// waitSync blocks until everything up to seq has been fsynced by the group
+// commit loop. It returns at once in the other modes.
+func (log *Log) waitSync(seq int64) error {
+	if log.SyncMode != SyncBatched || log.inMemory() {
+		return nil
+	}
+	select {
+	case log.kick <- struct{}{}:
+	default:
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	for log.syncedTo < seq && log.syncErr == nil {
+		log.synced.Wait()
+	}
+	return log.syncErr
+}
+
+func (log *Log) groupCommit() {
+	defer close(log.stopped)
+
+	interval := log.SyncInterval
+	if interval <= 0 {
+		interval = defaultSyncInterval
+	}
+	limit := log.SyncBytes
+	if limit <= 0 {
+		limit = defaultSyncBytes
+	}
+
+	for {
+		select {
+		case <-log.kick:
+		case <-log.done:
+			log.syncPending()
+			return
+		}
+
+		// give other writers a chance to join this fsync
+		timer := time.NewTimer(interval)
+	window:
+		for {
+			select {
+			case <-timer.C:
+				break window
+			case <-log.kick:
+				log.mu.Lock()
+				full := log.appended-log.syncedTo >= limit
+				log.mu.Unlock()
+				if full {
+					timer.Stop()
+					break window
+				}
+			case <-log.done:
+				timer.Stop()
+				log.syncPending()
+				return
+			}
+		}
+		log.syncPending()
+	}
+}
+
+func (log *Log) syncPending() {
+	log.mu.Lock()
+	target, fp := log.appended, log.fp
+	pending := target > log.syncedTo
+	log.mu.Unlock()
+	if !pending {
+		return
+	}
+
+	err := fp.Sync()
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if log.fp != fp {
+		return // the file was rewritten, which syncs it anyway
+	}
+	log.syncs++
+	if err != nil {
+		log.syncErr = err
+	} else if target > log.syncedTo {
+		log.syncedTo = target
+	}
+	log.synced.Broadcast()
+}
+
+// Offset is the current read position in the file.
+func (log *Log) Offset() (int64, error) {
+	if log.inMemory() {
+		return 0, nil
+	}
+	return log.fp.Seek(0, io.SeekCurrent)
+}
+
+// Truncate drops everything past off, makes that durable and positions
+// the file so that the next Write appends at off.
+func (log *Log) Truncate(off int64) error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	if log.inMemory() {
+		return nil
+	}
+	if err := log.fp.Truncate(off); err != nil {
+		return err
+	}
+	if err := log.fp.Sync(); err != nil {
+		return err
+	}
+	if _, err := log.fp.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	log.size = off
+	return nil
 }
 
 func (log *Log) Read(ent *Entry) (eof bool, err error) {
-	err = ent.Decode(log.fp)
+	if log.inMemory() {
+		return true, nil
+	}
+	off, err := log.Offset()
+	if err != nil {
+		return false, err
+	}
+	err = ent.decode(log.fp, log.size-off)
 	if err == io.EOF {
 		return true, nil
 	} else if err != nil {
@@ -35,3 +273,57 @@ func (log *Log) Read(ent *Entry) (eof bool, err error) {
 	}
 }
 
+// Rewrite replaces the log with a file holding only the given entries.
+// The new file is fsynced and renamed over the old one, so a crash leaves
+// either the old or the new log on disk. Writes continue on the new file.
+func (log *Log) Rewrite(ents []Entry) error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	if log.inMemory() {
+		return nil
+	}
+	tmpName := log.FileName + ".compact"
+	fp, err := createFileSync(tmpName)
+	if err != nil {
+		return err
+	}
+	size, err := writeEntries(fp, ents)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpName, log.FileName)
+	}
+	if err == nil {
+		err = syncDir(log.FileName)
+	}
+	if err != nil {
+		_ = fp.Close()
+		_ = os.Remove(tmpName)
+		return err
+	}
+
+	_ = log.fp.Close()
+	log.fp = fp
+	log.size = size
+	// the new file holds everything written so far
+	log.syncedTo = log.appended
+	log.synced.Broadcast()
+	return nil
+}
+
+func writeEntries(fp *os.File, ents []Entry) (size int64, err error) {
+	if err = fp.Truncate(0); err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(fp)
+	for i := range ents {
+		n, err := w.Write(ents[i].Encode())
+		if err != nil {
+			return 0, err
+		}
+		size += int64(n)
+	}
+	return size, w.Flush()
+}
@@ -0,0 +1,113 @@
+package kvdb
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogGroupCommit(t *testing.T) {
+	log := Log{FileName: ".test_db", SyncMode: SyncBatched, SyncInterval: time.Millisecond}
+	defer os.Remove(log.FileName)
+
+	os.Remove(log.FileName)
+	err := log.Open()
+	require.Nil(t, err)
+
+	const writers, perWriter = 8, 50
+	wg := sync.WaitGroup{}
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				ent := Entry{key: []byte(fmt.Sprintf("k%d_%d", w, i)), val: []byte("v")}
+				seq, err := log.append(ent.Encode())
+				assert.Nil(t, err)
+				assert.Nil(t, log.waitSync(seq))
+
+				// the entry must be durable once waitSync returns
+				log.mu.Lock()
+				assert.GreaterOrEqual(t, log.syncedTo, seq)
+				log.mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+	require.Nil(t, log.Close())
+
+	err = log.Open()
+	require.Nil(t, err)
+	defer log.Close()
+	count := 0
+	for {
+		ent := Entry{}
+		eof, err := log.Read(&ent)
+		require.Nil(t, err)
+		if eof {
+			break
+		}
+		count++
+	}
+	assert.Equal(t, writers*perWriter, count)
+}
+
+func TestLogSyncModes(t *testing.T) {
+	for _, mode := range []SyncMode{SyncAlways, SyncBatched, SyncNone} {
+		kv := KV{}
+		kv.log.FileName = ".test_db"
+		kv.SyncMode = mode
+		os.Remove(kv.log.FileName)
+
+		err := kv.Open()
+		require.Nil(t, err)
+		updated, err := kv.Set([]byte("k1"), []byte("v1"))
+		assert.True(t, updated && err == nil)
+		require.Nil(t, kv.Close())
+
+		err = kv.Open()
+		require.Nil(t, err)
+		val, ok, err := kv.Get([]byte("k1"))
+		assert.True(t, string(val) == "v1" && ok && err == nil)
+		require.Nil(t, kv.Close())
+		os.Remove(kv.log.FileName)
+	}
+}
+
+func TestKVSyncBatched(t *testing.T) {
+	const writers, perWriter = 8, 20
+	syncs := map[SyncMode]int64{}
+	for _, mode := range []SyncMode{SyncAlways, SyncBatched} {
+		kv := KV{SyncMode: mode}
+		kv.log.FileName = ".test_db"
+		os.Remove(kv.log.FileName)
+		require.Nil(t, kv.Open())
+
+		wg := sync.WaitGroup{}
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < perWriter; i++ {
+					_, err := kv.Set([]byte(fmt.Sprintf("k%d_%d", w, i)), []byte("v"))
+					assert.Nil(t, err)
+				}
+			}(w)
+		}
+		wg.Wait()
+		kv.log.mu.Lock()
+		syncs[mode] = kv.log.syncs
+		kv.log.mu.Unlock()
+		require.Nil(t, kv.Close())
+		os.Remove(kv.log.FileName)
+	}
+	// every write syncs on its own unless concurrent writers share fsyncs
+	assert.Equal(t, int64(writers*perWriter), syncs[SyncAlways])
+	assert.Less(t, syncs[SyncBatched], int64(writers*perWriter))
+	assert.Greater(t, syncs[SyncBatched], int64(0))
+}
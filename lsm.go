@@ -0,0 +1,643 @@
+package kvdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+EngineLSM keeps recent writes in the memtable (the sorted keys/vals of KV,
+where a nil value marks a deletion) backed by the log as a write-ahead log.
+A full memtable is flushed to a new SSTable in level 0 and the log is reset.
+
+Level 0 tables may overlap and are searched newest first. Every deeper
+level is a sorted run of non-overlapping tables that grows by levelRatio
+per level. A background goroutine merges level 0 into level 1 once it
+holds l0Trigger tables, and a table of a full level into the next one.
+
+The manifest names the tables of every level. It is replaced with a
+rename, so a crash leaves either the old or the new set of tables; tables
+that no manifest names are leftovers and are deleted by Open.
+*/
+const (
+	defaultMemtableSize = 4 << 20
+	l0Trigger           = 4
+	levelRatio          = 10
+)
+
+type lsm struct {
+	base      string // the log file name; tables and manifest are named after it
+	tableSize int64
+	levels    [][]*sstable // guarded by kv.mu
+	nextID    atomic.Uint64
+	cursor    map[int][]byte // where the next compaction of each level starts
+
+	cmu     sync.Mutex // one compaction at a time
+	kick    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type manifest struct {
+	Next   uint64
+	Levels [][]uint64
+}
+
+func (ls *lsm) manifestName() string { return ls.base + ".manifest" }
+
+func (ls *lsm) tableName(id uint64) string {
+	return ls.base + "." + strconv.FormatUint(id, 10) + ".sst"
+}
+
+func (ls *lsm) open() error {
+	ls.cursor = map[int][]byte{}
+	m := manifest{Next: 1}
+	data, err := os.ReadFile(ls.manifestName())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+	}
+	ls.nextID.Store(m.Next)
+
+	live := map[string]bool{}
+	ls.levels = make([][]*sstable, len(m.Levels))
+	for i, ids := range m.Levels {
+		for _, id := range ids {
+			t, err := openSST(ls.tableName(id), id)
+			if err != nil {
+				ls.close()
+				return err
+			}
+			ls.levels[i] = append(ls.levels[i], t)
+			live[t.path] = true
+		}
+	}
+	return ls.removeOrphans(live)
+}
+
+// removeOrphans deletes the tables of flushes and compactions that crashed
+// before their manifest was written.
+func (ls *lsm) removeOrphans(live map[string]bool) error {
+	dir, prefix := filepath.Dir(ls.base), filepath.Base(ls.base)+"."
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".sst") {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".sst")
+		if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+			continue
+		}
+		if path := filepath.Join(dir, name); !live[path] && !live[name] {
+			// the last reference of an obsolete table may remove it first
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ls *lsm) close() {
+	for _, level := range ls.levels {
+		for _, t := range level {
+			t.unref()
+		}
+	}
+	ls.levels = nil
+}
+
+// writeManifest atomically replaces the manifest with the given levels.
+func (ls *lsm) writeManifest(levels [][]*sstable) error {
+	m := manifest{Next: ls.nextID.Load(), Levels: make([][]uint64, len(levels))}
+	for i, level := range levels {
+		m.Levels[i] = []uint64{}
+		for _, t := range level {
+			m.Levels[i] = append(m.Levels[i], t.id)
+		}
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmpName := ls.manifestName() + ".tmp"
+	fp, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = fp.Write(data)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, ls.manifestName())
+	}
+	if err == nil {
+		err = syncDir(ls.manifestName())
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+	}
+	return err
+}
+
+// build writes the entries of iter into new tables. Tables are cut at
+// tableSize when split is set. Deletions are dropped when drop is set,
+// which is only safe when no older table can hold the key.
+func (ls *lsm) build(iter rawIter, split bool, drop bool) (tables []*sstable, err error) {
+	var sw *sstWriter
+	var id uint64
+	fail := func(err error) ([]*sstable, error) {
+		if sw != nil {
+			_ = sw.abort(err)
+		}
+		for _, t := range tables {
+			t.obsolete.Store(true)
+			t.unref()
+		}
+		return nil, err
+	}
+	for ; iter.Valid(); err = iter.Next() {
+		if err != nil {
+			return fail(err)
+		}
+		if drop && iter.deleted() {
+			continue
+		}
+		if sw == nil {
+			id = ls.nextID.Add(1) - 1
+			if sw, err = newSSTWriter(ls.tableName(id)); err != nil {
+				return fail(err)
+			}
+		}
+		ent := Entry{key: iter.Key(), val: iter.Val(), deleted: iter.deleted()}
+		if err = sw.add(&ent); err != nil {
+			return fail(err)
+		}
+		if split && sw.off >= ls.tableSize {
+			t, err := sw.finish(id)
+			if sw = nil; err != nil {
+				return fail(err)
+			}
+			tables = append(tables, t)
+		}
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if sw != nil {
+		t, err := sw.finish(id)
+		if sw = nil; err != nil {
+			return fail(err)
+		}
+		tables = append(tables, t)
+	}
+	if len(tables) > 0 {
+		if err = syncDir(ls.base); err != nil {
+			return fail(err)
+		}
+	}
+	return tables, nil
+}
+
+// getLevels finds the newest version of key in the tables of levels.
+func getLevels(levels [][]*sstable, key []byte) (val []byte, ok bool, err error) {
+	for i, level := range levels {
+		if i > 0 {
+			// the one table of a sorted level whose range may hold key
+			idx := findTable(level, key)
+			if idx == len(level) {
+				continue
+			}
+			level = level[idx : idx+1]
+		}
+		for _, t := range level {
+			ent, err := t.get(key)
+			if err != nil {
+				return nil, false, err
+			}
+			if ent != nil {
+				return ent.val, !ent.deleted, nil
+			}
+		}
+	}
+	return nil, false, nil
+}
+
+// findTable returns the first table of a sorted level ending at or after key.
+func findTable(level []*sstable, key []byte) int {
+	idx, _ := BinarySearchFunc(level, key, func(t *sstable, key []byte) int {
+		if bytes.Compare(t.last, key) < 0 {
+			return -1
+		}
+		return 1
+	})
+	return idx
+}
+
+// seekLevels returns iterators over the tables of levels positioned at the
+// first key >= key, newest first, and takes a reference on each table.
+func seekLevels(levels [][]*sstable, key []byte) (srcs []rawIter, tables []*sstable, err error) {
+	for i, level := range levels {
+		if len(level) == 0 {
+			continue
+		}
+		if i == 0 {
+			for _, t := range level {
+				iter, err := t.seek(key)
+				if err != nil {
+					return nil, nil, err
+				}
+				srcs = append(srcs, iter)
+			}
+		} else {
+			iter := &levelIter{tables: level}
+			if err := iter.seek(key); err != nil {
+				return nil, nil, err
+			}
+			srcs = append(srcs, iter)
+		}
+		tables = append(tables, level...)
+	}
+	for _, t := range tables {
+		t.ref()
+	}
+	return srcs, tables, nil
+}
+
+// levelIter walks the sorted run of tables in one level.
+type levelIter struct {
+	tables []*sstable
+	idx    int
+	iter   *sstIter
+}
+
+func (li *levelIter) seek(key []byte) (err error) {
+	li.idx = min(findTable(li.tables, key), len(li.tables)-1)
+	li.iter, err = li.tables[li.idx].seek(key)
+	return err
+}
+
+func (li *levelIter) Valid() bool   { return li.iter.Valid() }
+func (li *levelIter) Key() []byte   { return li.iter.Key() }
+func (li *levelIter) Val() []byte   { return li.iter.Val() }
+func (li *levelIter) deleted() bool { return li.iter.deleted() }
+func (li *levelIter) Close()        {}
+
+func (li *levelIter) Next() error {
+	if err := li.iter.Next(); err != nil || li.iter.Valid() || li.idx+1 == len(li.tables) {
+		return err
+	}
+	li.idx++
+	iter, err := li.tables[li.idx].seek(nil)
+	li.iter = iter
+	return err
+}
+
+func (li *levelIter) Prev() error {
+	if err := li.iter.Prev(); err != nil || li.iter.Valid() || li.idx == 0 {
+		return err
+	}
+	li.idx--
+	t := li.tables[li.idx]
+	li.iter = &sstIter{table: t}
+	if err := li.iter.loadBlock(len(t.first) - 1); err != nil {
+		return err
+	}
+	li.iter.pos = len(li.iter.ents) - 1
+	return nil
+}
+
+// compaction merges tables of one level into the next.
+type compaction struct {
+	level  int
+	inputs []*sstable // from level
+	lower  []*sstable // overlapping tables from level+1
+	drop   bool       // no deeper level, so deletions can go
+}
+
+func (ls *lsm) levelLimit(level int) int64 {
+	limit := ls.tableSize
+	for i := 0; i < level; i++ {
+		limit *= levelRatio
+	}
+	return limit
+}
+
+// pick chooses the next compaction, or nil; the caller holds kv.mu.
+func (ls *lsm) pick() *compaction {
+	c := &compaction{level: -1}
+	if len(ls.levels) > 0 && len(ls.levels[0]) >= l0Trigger {
+		c.level = 0
+		c.inputs = slices.Clone(ls.levels[0])
+	}
+	for i := 1; c.level < 0 && i < len(ls.levels); i++ {
+		size := int64(0)
+		for _, t := range ls.levels[i] {
+			size += t.size
+		}
+		if size <= ls.levelLimit(i) {
+			continue
+		}
+		// take turns over the level so that every key range gets merged down
+		idx := 0
+		if cursor := ls.cursor[i]; cursor != nil {
+			idx = findTable(ls.levels[i], cursor) % len(ls.levels[i])
+		}
+		c.level = i
+		c.inputs = ls.levels[i][idx : idx+1]
+		ls.cursor[i] = append(slices.Clone(c.inputs[0].last), 0)
+	}
+	if c.level < 0 {
+		return nil
+	}
+
+	lo, hi := c.inputs[0].first[0], c.inputs[0].last
+	for _, t := range c.inputs {
+		if bytes.Compare(t.first[0], lo) < 0 {
+			lo = t.first[0]
+		}
+		if bytes.Compare(t.last, hi) > 0 {
+			hi = t.last
+		}
+	}
+	c.drop = true
+	for i := c.level + 2; i < len(ls.levels); i++ {
+		if len(ls.levels[i]) > 0 {
+			c.drop = false
+		}
+	}
+	if c.level+1 < len(ls.levels) {
+		for _, t := range ls.levels[c.level+1] {
+			if t.overlaps(lo, hi) {
+				c.lower = append(c.lower, t)
+			}
+		}
+	}
+	return c
+}
+
+// run merges the compaction's tables into new ones without holding kv.mu;
+// tables are immutable and stay referenced by their level until install.
+func (ls *lsm) run(c *compaction) ([]*sstable, error) {
+	srcs := []rawIter{}
+	for _, t := range c.inputs {
+		iter, err := t.seek(nil)
+		if err != nil {
+			return nil, err
+		}
+		srcs = append(srcs, iter)
+	}
+	if len(c.lower) > 0 {
+		iter := &levelIter{tables: c.lower}
+		if err := iter.seek(nil); err != nil {
+			return nil, err
+		}
+		srcs = append(srcs, iter)
+	}
+	iter, err := newMergeIter(srcs, true)
+	if err != nil {
+		return nil, err
+	}
+	return ls.build(iter, true, c.drop)
+}
+
+// install swaps the compaction's tables for the output; the caller holds
+// kv.mu. Tables flushed to level 0 in the meantime are kept.
+func (ls *lsm) install(c *compaction, out []*sstable) error {
+	gone := map[*sstable]bool{}
+	for _, t := range append(slices.Clone(c.inputs), c.lower...) {
+		gone[t] = true
+	}
+	levels := make([][]*sstable, max(len(ls.levels), c.level+2))
+	for i := range levels {
+		if i < len(ls.levels) {
+			for _, t := range ls.levels[i] {
+				if !gone[t] {
+					levels[i] = append(levels[i], t)
+				}
+			}
+		}
+		if i == c.level+1 {
+			levels[i] = append(levels[i], out...)
+			slices.SortFunc(levels[i], func(a *sstable, b *sstable) int {
+				return bytes.Compare(a.first[0], b.first[0])
+			})
+		}
+	}
+	if err := ls.writeManifest(levels); err != nil {
+		return err
+	}
+	ls.levels = levels
+	for t := range gone {
+		t.obsolete.Store(true)
+		t.unref()
+	}
+	return nil
+}
+
+// flush writes the memtable to a level 0 table and resets the log; the
+// caller holds kv.mu.
+func (kv *KV) flush() error {
+	if len(kv.keys) == 0 {
+		return nil
+	}
+	ls := kv.lsm
+	tables, err := ls.build(&memIter{keys: kv.keys, vals: kv.vals}, false, false)
+	if err != nil {
+		return err
+	}
+	levels := slices.Clone(ls.levels)
+	if len(levels) == 0 {
+		levels = append(levels, nil)
+	}
+	levels[0] = append(tables, levels[0]...)
+	if err = ls.writeManifest(levels); err != nil {
+		tables[0].obsolete.Store(true)
+		tables[0].unref()
+		return err
+	}
+	ls.levels = levels
+	// the table holds everything in the log now
+	if err = kv.log.Rewrite(nil); err != nil {
+		return err
+	}
+	kv.keys, kv.vals = nil, nil
+	kv.shared.Store(false)
+	kv.liveBytes = 0
+
+	select {
+	case ls.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// maybeFlush flushes a full memtable. A failure is kept in compactErr
+// instead of failing the write, which is already in the log.
+func (kv *KV) maybeFlush() {
+	limit := kv.MemtableSize
+	if limit <= 0 {
+		limit = defaultMemtableSize
+	}
+	if kv.liveBytes < limit || kv.compactErr != nil {
+		return
+	}
+	kv.compactErr = kv.flush()
+}
+
+// compactLevels runs compactions until every level is within its limit.
+func (kv *KV) compactLevels() error {
+	ls := kv.lsm
+	ls.cmu.Lock()
+	defer ls.cmu.Unlock()
+	for {
+		kv.mu.Lock()
+		c := ls.pick()
+		kv.mu.Unlock()
+		if c == nil {
+			return nil
+		}
+
+		out, err := ls.run(c)
+		if err == nil {
+			kv.mu.Lock()
+			err = ls.install(c, out)
+			kv.mu.Unlock()
+		}
+		if err != nil {
+			for _, t := range out {
+				t.obsolete.Store(true)
+				t.unref()
+			}
+			return err
+		}
+	}
+}
+
+func (kv *KV) compactLoop() {
+	ls := kv.lsm
+	defer close(ls.stopped)
+	for {
+		select {
+		case <-ls.done:
+			return
+		case <-ls.kick:
+		}
+		if err := kv.compactLevels(); err != nil {
+			kv.mu.Lock()
+			kv.compactErr = err
+			kv.mu.Unlock()
+		}
+	}
+}
+
+func (kv *KV) startLSM() {
+	ls := kv.lsm
+	ls.kick = make(chan struct{}, 1)
+	ls.done = make(chan struct{})
+	ls.stopped = make(chan struct{})
+	go kv.compactLoop()
+	ls.kick <- struct{}{}
+}
+
+// stopLSM waits for a running compaction; the caller does not hold kv.mu.
+func (kv *KV) stopLSM() {
+	if ls := kv.lsm; ls != nil && ls.done != nil {
+		close(ls.done)
+		<-ls.stopped
+		ls.done = nil
+	}
+}
+
+// lsmView is the memtable and the set of tables at one point in time.
+type lsmView struct {
+	keys   [][]byte
+	vals   [][]byte
+	levels [][]*sstable
+}
+
+// lsmView freezes the current state; the caller holds kv.mu. The levels
+// are never modified in place, flushes and compactions replace them.
+func (kv *KV) lsmView() *lsmView {
+	kv.shared.Store(true)
+	view := &lsmView{keys: kv.keys, vals: kv.vals, levels: kv.lsm.levels}
+	for _, level := range view.levels {
+		for _, t := range level {
+			t.ref()
+		}
+	}
+	return view
+}
+
+func (view *lsmView) release() {
+	for _, level := range view.levels {
+		for _, t := range level {
+			t.unref()
+		}
+	}
+}
+
+func (view *lsmView) get(key []byte) ([]byte, bool, error) {
+	if idx, found := BinarySearchFunc(view.keys, key, bytes.Compare); found {
+		return view.vals[idx], view.vals[idx] != nil, nil
+	}
+	return getLevels(view.levels, key)
+}
+
+// seek merges the memtable with the tables.
+func (view *lsmView) seek(key []byte) (kvCursor, error) {
+	srcs, tables, err := seekLevels(view.levels, key)
+	if err != nil {
+		return nil, err
+	}
+	idx, _ := BinarySearchFunc(view.keys, key, bytes.Compare)
+	mem := &memIter{keys: view.keys, vals: view.vals, pos: idx}
+	merged, err := newMergeIter(append([]rawIter{mem}, srcs...), false)
+	iter := &lsmIter{mergeIter: merged, tables: tables}
+	if err != nil {
+		iter.Close()
+		return nil, err
+	}
+	// the finalizer only covers iterators that are never closed
+	runtime.SetFinalizer(iter, (*lsmIter).Close)
+	return iter, nil
+}
+
+// lsmIter holds a reference on the tables it reads until Close.
+type lsmIter struct {
+	*mergeIter
+	tables []*sstable
+	closed bool
+}
+
+func (iter *lsmIter) Close() {
+	if iter.closed {
+		return
+	}
+	iter.closed = true
+	runtime.SetFinalizer(iter, nil)
+	for _, t := range iter.tables {
+		t.unref()
+	}
+	iter.mergeIter.Close()
+}
@@ -0,0 +1,275 @@
+package kvdb
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func removeLSM() {
+	files, _ := filepath.Glob(".test_db*")
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+func openLSM(t *testing.T) *KV {
+	kv := &KV{Engine: EngineLSM, MemtableSize: 4096}
+	kv.log.FileName = ".test_db"
+	kv.SyncMode = SyncNone
+	require.Nil(t, kv.Open())
+	return kv
+}
+
+func TestSSTable(t *testing.T) {
+	removeLSM()
+	defer removeLSM()
+
+	sw, err := newSSTWriter(".test_db.1.sst")
+	require.Nil(t, err)
+	keys := []string{}
+	for i := 0; i < 500; i++ {
+		k := fmt.Sprintf("k%03d", i)
+		ent := Entry{key: []byte(k), val: []byte(fmt.Sprintf("v%050d", i)), deleted: i%7 == 0}
+		if ent.deleted {
+			ent.val = nil
+		}
+		require.Nil(t, sw.add(&ent))
+		keys = append(keys, k)
+	}
+	table, err := sw.finish(1)
+	require.Nil(t, err)
+	defer table.unref()
+	assert.Greater(t, len(table.first), 1)
+	assert.Equal(t, "k499", string(table.last))
+
+	ent, err := table.get([]byte("k123"))
+	require.True(t, err == nil && ent != nil)
+	assert.Equal(t, fmt.Sprintf("v%050d", 123), string(ent.val))
+	ent, err = table.get([]byte("k007"))
+	require.True(t, err == nil && ent != nil && ent.deleted)
+	ent, err = table.get([]byte("k1234"))
+	assert.True(t, err == nil && ent == nil)
+
+	iter, err := table.seek([]byte("k2"))
+	require.Nil(t, err)
+	for i := 200; i < len(keys); i++ {
+		require.True(t, iter.Valid())
+		require.Equal(t, keys[i], string(iter.Key()))
+		require.Equal(t, i%7 == 0, iter.deleted())
+		require.Nil(t, iter.Next())
+	}
+	assert.False(t, iter.Valid())
+	for i := len(keys) - 1; i >= 0; i-- {
+		require.Nil(t, iter.Prev())
+		require.Equal(t, keys[i], string(iter.Key()))
+	}
+	require.Nil(t, iter.Prev())
+	assert.False(t, iter.Valid())
+
+	iter, err = table.seek([]byte("z"))
+	require.Nil(t, err)
+	assert.False(t, iter.Valid())
+}
+
+func TestMergeIter(t *testing.T) {
+	mem := func(pairs ...string) *memIter {
+		iter := &memIter{}
+		for i := 0; i < len(pairs); i += 2 {
+			iter.keys = append(iter.keys, []byte(pairs[i]))
+			val := []byte(pairs[i+1])
+			if pairs[i+1] == "-" {
+				val = nil // deleted
+			}
+			iter.vals = append(iter.vals, val)
+		}
+		return iter
+	}
+	srcs := []rawIter{
+		mem("b", "new", "d", "-"),
+		mem(),
+		mem("a", "1", "b", "old", "c", "-", "d", "4", "e", "5"),
+		mem("c", "3", "f", "-"),
+	}
+	iter, err := newMergeIter(srcs, false)
+	require.Nil(t, err)
+
+	got := []string{}
+	for ; iter.Valid(); iter.Next() {
+		got = append(got, string(iter.Key())+"="+string(iter.Val()))
+	}
+	assert.Equal(t, []string{"a=1", "b=new", "e=5"}, got)
+
+	got = got[:0]
+	for iter.Prev(); iter.Valid(); iter.Prev() {
+		got = append(got, string(iter.Key()))
+	}
+	assert.Equal(t, []string{"e", "b", "a"}, got)
+
+	// turning around in the middle
+	require.Nil(t, iter.Next())
+	require.Nil(t, iter.Next())
+	assert.Equal(t, "b", string(iter.Key()))
+	require.Nil(t, iter.Prev())
+	assert.Equal(t, "a", string(iter.Key()))
+	require.Nil(t, iter.Next())
+	require.Nil(t, iter.Next())
+	assert.Equal(t, "e", string(iter.Key()))
+	require.Nil(t, iter.Prev())
+	assert.Equal(t, "b", string(iter.Key()))
+}
+
+func TestLSMFlushFailure(t *testing.T) {
+	removeLSM()
+	defer removeLSM()
+	kv := openLSM(t)
+	defer kv.Close()
+
+	// the manifest cannot be rewritten
+	require.Nil(t, os.Mkdir(".test_db.manifest.tmp", 0o755))
+	for i := 0; i < 200; i++ {
+		updated, err := kv.Set([]byte(fmt.Sprintf("k%03d", i)), make([]byte, 50))
+		require.True(t, updated && err == nil)
+	}
+	assert.NotNil(t, kv.CompactErr())
+	_, ok, err := kv.Get([]byte("k199"))
+	assert.True(t, ok && err == nil)
+
+	os.Remove(".test_db.manifest.tmp")
+	require.Nil(t, kv.Compact())
+	assert.Nil(t, kv.CompactErr())
+	_, ok, err = kv.Get([]byte("k000"))
+	assert.True(t, ok && err == nil)
+}
+
+func TestLSMRandom(t *testing.T) {
+	removeLSM()
+	defer removeLSM()
+	kv := openLSM(t)
+
+	ref := map[string]string{}
+	verify := func() {
+		keys := []string{}
+		for k := range ref {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+
+		got := []string{}
+		iter, err := kv.Seek(nil)
+		require.Nil(t, err)
+		for ; iter.Valid(); iter.Next() {
+			got = append(got, string(iter.Key()))
+			require.Equal(t, ref[string(iter.Key())], string(iter.Val()))
+		}
+		require.Equal(t, keys, got)
+
+		iter.Prev()
+		for i := len(keys) - 1; i >= 0; i-- {
+			require.True(t, iter.Valid())
+			require.Equal(t, keys[i], string(iter.Key()))
+			iter.Prev()
+		}
+		require.False(t, iter.Valid())
+
+		for i := 0; i < 100; i++ {
+			k := fmt.Sprintf("key%05d", rand.IntN(3000))
+			val, ok, err := kv.Get([]byte(k))
+			want, exists := ref[k]
+			require.True(t, err == nil && ok == exists && string(val) == want)
+		}
+	}
+
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 3000; i++ {
+			k := fmt.Sprintf("key%05d", rand.IntN(3000))
+			switch rand.IntN(3) {
+			case 0:
+				_, err := kv.Del([]byte(k))
+				require.Nil(t, err)
+				delete(ref, k)
+			default:
+				v := fmt.Sprintf("%0*d", rand.IntN(50), i)
+				_, err := kv.Set([]byte(k), []byte(v))
+				require.Nil(t, err)
+				ref[k] = v
+			}
+		}
+		verify()
+		require.Nil(t, kv.Close())
+		kv = openLSM(t)
+		verify()
+	}
+
+	require.Nil(t, kv.Compact())
+	verify()
+	assert.Empty(t, kv.keys)
+	assert.Less(t, len(kv.lsm.levels[0]), l0Trigger)
+	assert.Greater(t, len(kv.lsm.levels), 1)
+	require.Nil(t, kv.Close())
+
+	// only the tables of the manifest are left on disk
+	kv = openLSM(t)
+	defer kv.Close()
+	verify()
+	files, _ := filepath.Glob(".test_db.*.sst")
+	count := 0
+	for _, level := range kv.lsm.levels {
+		count += len(level)
+	}
+	assert.Equal(t, count, len(files))
+}
+
+func TestLSMSnapshot(t *testing.T) {
+	removeLSM()
+	defer removeLSM()
+	kv := openLSM(t)
+	defer kv.Close()
+
+	for i := 0; i < 300; i++ {
+		_, err := kv.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("old"))
+		require.Nil(t, err)
+	}
+	iter, err := kv.Seek([]byte("k"))
+	require.Nil(t, err)
+
+	// the iterator keeps the tables it reads alive through compactions
+	for i := 0; i < 300; i++ {
+		_, err = kv.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("new"))
+		require.Nil(t, err)
+		_, err = kv.Del([]byte(fmt.Sprintf("k%03d", i)))
+		require.Nil(t, err)
+	}
+	require.Nil(t, kv.Compact())
+	runtime.GC()
+
+	count := 0
+	for ; iter.Valid(); require.Nil(t, iter.Next()) {
+		assert.Equal(t, fmt.Sprintf("k%03d", count), string(iter.Key()))
+		assert.Equal(t, "old", string(iter.Val()))
+		count++
+	}
+	assert.Equal(t, 300, count)
+
+	// Close drops the references, which removes the compacted tables
+	tables := iter.cur.(*lsmIter).tables
+	require.NotEmpty(t, tables)
+	iter.Close()
+	iter.Close()
+	for _, table := range tables {
+		require.True(t, table.obsolete.Load())
+		_, err = os.Stat(table.path)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	iter, err = kv.Seek(nil)
+	require.Nil(t, err)
+	assert.False(t, iter.Valid())
+}
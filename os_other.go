@@ -8,4 +8,6 @@ func createFileSync(file string) (*os.File, error) {
 	return os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0o644)
 }
 
-
+func syncDir(file string) error {
+	return nil
+}
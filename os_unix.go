@@ -14,7 +14,7 @@ func createFileSync(file string) (*os.File, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err = syncDir(path.Base(file)); err != nil {
+	if err = syncDir(file); err != nil {
 		_ = fp.Close()
 		return nil, err
 	}
@@ -0,0 +1,486 @@
+package kvdb
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+)
+
+/*
+The planner picks how a query reads a table. The WHERE conjuncts of the
+form `column op value` can narrow the rows to read: equalities on a prefix
+of the primary key, or of an index, followed by bounds on the next column
+give a key range, and so does the literal prefix of a LIKE pattern. The plan is the access path that uses the most of them:
+
+  - point gets when the whole primary key is given, by equalities or IN
+    lists,
+  - a primary key range,
+  - an index range, which reads the row of every index entry,
+  - or a full scan when nothing helps.
+
+The conjuncts the access path does not already ensure are checked per row.
+An ORDER BY that follows the primary key is a scan in that direction, any
+other one sorts the rows.
+*/
+
+type planKind int
+
+const (
+	planFull  planKind = iota // every row of the table
+	planPoint                 // rows by their primary keys
+	planRange                 // a primary key range
+	planIndex                 // an index range
+)
+
+type queryPlan struct {
+	kind   planKind
+	index  *Index    // planIndex
+	points []Row     // planPoint, in primary key order
+	scan   ScanRange // planRange and planIndex, and the direction of planFull
+	filter []Expr    // the conjuncts left to check per row
+	sort   []sortCol // the ORDER BY the access path does not give
+	limit  int64     // -1 without LIMIT
+	offset int64
+	// DISTINCT on the output columns, and whether equal ones come one
+	// after another
+	distinct []Expr
+	adjacent bool
+	// the rows execPlan read, for EXPLAIN ANALYZE
+	examined int
+}
+
+// rowCond is a WHERE conjunct of the form `column op value`, with op one
+// of = < <= > >=, or `column IN values`, which can narrow a key range.
+type rowCond struct {
+	col    int
+	op     string
+	value  Cell
+	values []Cell // IN
+	expr   int    // the conjunct it comes from
+	loose  bool   // implied by the conjunct, which still needs a check
+}
+
+// flippedOps turns `value op column` into `column op value`.
+var flippedOps = map[string]string{"=": "=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+
+// bindWhere binds the WHERE clause and splits it at its top level ANDs.
+func bindWhere(schema *Schema, where Expr) ([]Expr, error) {
+	if where == nil {
+		return nil, nil
+	}
+	expr, typ, err := bindExpr(schema, where)
+	if err != nil {
+		return nil, err
+	}
+	if typ != TypeI64 {
+		return nil, errors.New("WHERE expects a truth value")
+	}
+	if hasAggregate(expr) {
+		return nil, errors.New("aggregates are not allowed in WHERE")
+	}
+	return conjuncts(expr), nil
+}
+
+// keyConds picks the conjuncts that compare a column with a value.
+func keyConds(conjs []Expr) []rowCond {
+	conds := []rowCond{}
+	for i, expr := range conjs {
+		if e, ok := expr.(*ExprIn); ok {
+			col, ok := e.expr.(*exprCol)
+			values := []Cell{}
+			for _, item := range e.list {
+				if value, ok := item.(Cell); ok {
+					values = append(values, value)
+				}
+			}
+			if ok && len(values) == len(e.list) {
+				conds = append(conds, rowCond{col: col.col, op: "IN", values: values, expr: i})
+			}
+			continue
+		}
+		if e, ok := expr.(*ExprLike); ok {
+			conds = append(conds, likeConds(e, i)...)
+			continue
+		}
+		e, ok := expr.(*ExprBinary)
+		if !ok || flippedOps[e.op] == "" {
+			continue
+		}
+		if col, ok := e.left.(*exprCol); ok {
+			if value, ok := e.right.(Cell); ok {
+				conds = append(conds, rowCond{col: col.col, op: e.op, value: value, expr: i})
+			}
+		} else if col, ok := e.right.(*exprCol); ok {
+			if value, ok := e.left.(Cell); ok {
+				conds = append(conds, rowCond{col: col.col, op: flippedOps[e.op], value: value, expr: i})
+			}
+		}
+	}
+	return conds
+}
+
+// outputColumn finds the output column an ORDER BY name refers to: by its
+// alias or name, or else as the column it shows. It returns -1 if none.
+func outputColumn(name string, exprs []Expr, names []string) int {
+	if i := slices.IndexFunc(names, func(n string) bool { return strings.EqualFold(n, name) }); i >= 0 {
+		return i
+	}
+	return slices.IndexFunc(exprs, func(expr Expr) bool {
+		col, ok := expr.(*exprCol)
+		return ok && strings.EqualFold(col.name, name)
+	})
+}
+
+// resolveOrder resolves ORDER BY against the output columns exprs, named
+// names, then the table, and reports whether it follows the primary key,
+// which the rows are stored in, all in one direction.
+func resolveOrder(schema *Schema, order []OrderBy, exprs []Expr, names []string) (cols []sortCol, pkey bool, err error) {
+	pkey = true
+	for i, o := range order {
+		col := -1
+		if out := outputColumn(o.column, exprs, names); out >= 0 {
+			e, ok := exprs[out].(*exprCol)
+			if !ok {
+				return nil, false, errors.New("ORDER BY " + o.column + " can only sort on a column")
+			}
+			col = e.col
+		} else if found, err := lookupColumns(schema.Cols, []string{o.column}); err == nil {
+			col = found[0]
+		} else {
+			return nil, false, errors.New("ORDER BY " + o.column + " is not a column or an output name")
+		}
+		cols = append(cols, sortCol{col: col, desc: o.desc})
+		if i >= len(schema.PKey) || col != schema.PKey[i] || o.desc != order[0].desc {
+			pkey = false
+		}
+	}
+	return cols, pkey, nil
+}
+
+// planSelect plans a query without aggregates over the output columns
+// exprs, named names.
+func planSelect(schema *Schema, stmt *StmtSelect, exprs []Expr, names []string) (*queryPlan, error) {
+	conjs, err := bindWhere(schema, stmt.where)
+	if err != nil {
+		return nil, err
+	}
+	order, pkey, err := resolveOrder(schema, stmt.order, exprs, names)
+	if err != nil {
+		return nil, err
+	}
+	// an index returns the rows in its own order, which a sort can fix
+	plan := planQuery(schema, conjs, len(order) == 0 || !pkey)
+	if pkey {
+		plan.scan.Reverse = len(order) > 0 && order[0].desc
+	} else {
+		plan.sort = order
+	}
+	plan.limit, plan.offset = -1, stmt.offset
+	if stmt.hasLimit {
+		plan.limit = stmt.limit
+	}
+	return plan, nil
+}
+
+// likeConds bounds a column to the strings that start with the literal
+// prefix of a LIKE pattern; they sort next to each other.
+func likeConds(e *ExprLike, expr int) []rowCond {
+	col, ok := e.expr.(*exprCol)
+	pattern, isCell := e.pattern.(Cell)
+	if !ok || !isCell || len(likePrefix(pattern.Str)) == 0 {
+		return nil
+	}
+	prefix := likePrefix(pattern.Str)
+	conds := []rowCond{{col: col.col, op: ">=", value: Cell{Type: TypeStr, Str: prefix}, expr: expr, loose: true}}
+	// the first string past the prefix, none if it is all 0xff
+	end := slices.Clone(prefix)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) > 0 {
+		end[len(end)-1]++
+		conds = append(conds, rowCond{col: col.col, op: "<", value: Cell{Type: TypeStr, Str: end}, expr: expr, loose: true})
+	}
+	return conds
+}
+
+// planQuery picks the access path for the WHERE conjuncts. Index ranges
+// are only considered when the rows may come in any order.
+func planQuery(schema *Schema, conjs []Expr, anyOrder bool) *queryPlan {
+	conds := keyConds(conjs)
+	r, used, score := keyRange(schema.PKey, conds)
+	plan := &queryPlan{kind: planRange, scan: r}
+	if points, pused := pointKeys(schema, conds); points != nil {
+		plan = &queryPlan{kind: planPoint, points: points}
+		used = pused
+	}
+	for i := range schema.Indexes {
+		if !anyOrder || plan.kind == planPoint {
+			break
+		}
+		ir, iused, iscore := keyRange(schema.Indexes[i].Cols, conds)
+		// on a tie the primary key wins, it needs no extra read per row
+		if iscore > score {
+			plan = &queryPlan{kind: planIndex, index: &schema.Indexes[i], scan: ir}
+			used, score = iused, iscore
+		}
+	}
+	if score == 0 && plan.kind != planPoint {
+		plan = &queryPlan{kind: planFull}
+	}
+	ensured := map[int]bool{}
+	for _, i := range used {
+		ensured[conds[i].expr] = !conds[i].loose
+	}
+	for i := range conjs {
+		if !ensured[i] {
+			plan.filter = append(plan.filter, conjs[i])
+		}
+	}
+	return plan
+}
+
+// pointKeys lists the primary keys that the equalities and IN lists allow,
+// sorted and without duplicates, or nil unless they cover every column.
+func pointKeys(schema *Schema, conds []rowCond) (keys []Row, used []int) {
+	keys = []Row{schema.NewRow()}
+	for _, col := range schema.PKey {
+		idx := slices.IndexFunc(conds, func(c rowCond) bool { return c.col == col && c.op == "=" })
+		if idx < 0 {
+			idx = slices.IndexFunc(conds, func(c rowCond) bool { return c.col == col && c.op == "IN" })
+		}
+		if idx < 0 {
+			return nil, nil
+		}
+		values := conds[idx].values
+		if conds[idx].op == "=" {
+			values = []Cell{conds[idx].value}
+		}
+		next := []Row{}
+		for _, key := range keys {
+			for _, value := range values {
+				key := slices.Clone(key)
+				key[col] = value
+				next = append(next, key)
+			}
+		}
+		keys = next
+		used = append(used, idx)
+	}
+	compare := func(a Row, b Row) int {
+		for _, col := range schema.PKey {
+			if r := a[col].Compare(&b[col]); r != 0 {
+				return r
+			}
+		}
+		return 0
+	}
+	slices.SortFunc(keys, compare)
+	keys = slices.CompactFunc(keys, func(a Row, b Row) bool { return compare(a, b) == 0 })
+	return keys, used
+}
+
+// keyRange finds the key range of the columns of a key that the predicates
+// allow: equalities on a prefix of them, then bounds on the next one. It
+// returns the predicates that the range ensures and a score that grows with
+// how narrow the range is.
+func keyRange(cols []int, conds []rowCond) (r ScanRange, used []int, score int) {
+	prefix := []Cell{}
+	for _, col := range cols {
+		idx := slices.IndexFunc(conds, func(c rowCond) bool { return c.col == col && c.op == "=" })
+		if idx < 0 {
+			break
+		}
+		prefix = append(prefix, conds[idx].value)
+		used = append(used, idx)
+	}
+	r = ScanRange{Start: prefix, StartIncl: true, End: prefix, EndIncl: true}
+	score = 2 * len(prefix)
+	if len(prefix) == len(cols) {
+		return r, used, score
+	}
+
+	// the tightest bounds on the next column, which ensure the looser ones
+	next := cols[len(prefix)]
+	var lower, upper *rowCond
+	var lowers, uppers []int
+	for i := range conds {
+		c := &conds[i]
+		if c.col != next {
+			continue
+		}
+		switch c.op {
+		case ">", ">=":
+			lowers = append(lowers, i)
+			if tighter(lower, c, 1) {
+				lower = c
+			}
+		case "<", "<=":
+			uppers = append(uppers, i)
+			if tighter(upper, c, -1) {
+				upper = c
+			}
+		}
+	}
+	if lower != nil {
+		r.Start, r.StartIncl = append(slices.Clone(prefix), lower.value), lower.op == ">="
+		used = append(used, lowers...)
+		score++
+	}
+	if upper != nil {
+		r.End, r.EndIncl = append(slices.Clone(prefix), upper.value), upper.op == "<="
+		used = append(used, uppers...)
+		score++
+	}
+	return r, used, score
+}
+
+// tighter reports whether c bounds the column more than bound does; dir is
+// 1 for lower bounds and -1 for upper bounds.
+func tighter(bound *rowCond, c *rowCond, dir int) bool {
+	if bound == nil {
+		return true
+	}
+	r := c.value.Compare(&bound.value) * dir
+	return r > 0 || (r == 0 && (c.op == ">" || c.op == "<"))
+}
+
+func (plan *queryPlan) match(row Row) bool {
+	return !slices.ContainsFunc(plan.filter, func(e Expr) bool { return !isTrue(evalExpr(e, row)) })
+}
+
+// setDistinct makes the query return distinct output columns exprs. The
+// rows of a primary key order bring equal primary key prefixes together,
+// so no set of the seen ones is needed for them.
+func (plan *queryPlan) setDistinct(schema *Schema, exprs []Expr) {
+	plan.distinct = exprs
+	cols := []int{}
+	for _, expr := range exprs {
+		col, ok := expr.(*exprCol)
+		if !ok {
+			return
+		}
+		if !slices.Contains(cols, col.col) {
+			cols = append(cols, col.col)
+		}
+	}
+	prefix := schema.PKey[:min(len(cols), len(schema.PKey))]
+	plan.adjacent = plan.sort == nil && plan.kind != planIndex && len(prefix) == len(cols) &&
+		!slices.ContainsFunc(prefix, func(col int) bool { return !slices.Contains(cols, col) })
+}
+
+// distinctKey encodes the cells of the row, each with its type, so that
+// equal keys mean equal cells.
+func distinctKey(row Row) []byte {
+	key := []byte{}
+	for i := range row {
+		key = append(key, byte(row[i].Type))
+		if row[i].Type != 0 {
+			key = row[i].EncodeKey(key)
+		}
+	}
+	return key
+}
+
+// errStopScan ends a scan once LIMIT has the rows.
+var errStopScan = errors.New("stop the scan")
+
+// execQuery calls fn with the rows of the query in order, dropping the
+// duplicates for DISTINCT, skipping OFFSET rows and stopping at LIMIT.
+// Without a sort the scan stops there too.
+func (tx *Tx) execQuery(schema *Schema, plan *queryPlan, fn func(Row) error) error {
+	skip, left := plan.offset, plan.limit
+	if left == 0 {
+		return nil
+	}
+	var last []byte
+	seen := map[string]bool{}
+	emit := func(row Row) error {
+		if plan.distinct != nil {
+			key := distinctKey(project(plan.distinct, row))
+			if plan.adjacent {
+				if bytes.Equal(key, last) {
+					return nil
+				}
+				last = key
+			} else {
+				if seen[string(key)] {
+					return nil
+				}
+				seen[string(key)] = true
+			}
+		}
+		if skip > 0 {
+			skip--
+			return nil
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+		if left--; left == 0 {
+			return errStopScan
+		}
+		return nil
+	}
+
+	var err error
+	if plan.sort == nil {
+		err = tx.execPlan(schema, plan, emit)
+	} else {
+		sorter := newRowSorter(schema, plan.sort)
+		defer sorter.Close()
+		if err = tx.execPlan(schema, plan, sorter.Add); err == nil {
+			err = sorter.Each(emit)
+		}
+	}
+	if err == errStopScan {
+		err = nil
+	}
+	return err
+}
+
+// execPlan calls fn with every row the plan selects.
+func (tx *Tx) execPlan(schema *Schema, plan *queryPlan, fn func(Row) error) error {
+	var iter *RowIterator
+	var err error
+	switch plan.kind {
+	case planPoint:
+		for i := range plan.points {
+			if plan.scan.Reverse {
+				i = len(plan.points) - 1 - i
+			}
+			row := slices.Clone(plan.points[i])
+			ok, err := tx.Select(schema, row)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if plan.examined++; plan.match(row) {
+				if err = fn(row); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case planIndex:
+		iter, err = tx.ScanIndex(schema, plan.index.Name, plan.scan)
+	default:
+		iter, err = tx.Scan(schema, plan.scan)
+	}
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for ; err == nil && iter.Valid(); err = iter.Next() {
+		plan.examined++
+		if row := iter.Row(); plan.match(row) {
+			if err = fn(row); err != nil {
+				return err
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package kvdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanner(t *testing.T) {
+	schema := &Schema{
+		Table: "t",
+		Cols: []Column{
+			{Name: "a", Type: TypeI64},
+			{Name: "b", Type: TypeI64},
+			{Name: "c", Type: TypeI64},
+			{Name: "d", Type: TypeStr},
+		},
+		PKey:    []int{0, 1},
+		Indexes: []Index{{Name: "by_c", Cols: []int{2}}, {Name: "by_dc", Cols: []int{3, 2}}},
+	}
+	plan := func(s string) *queryPlan {
+		stmt := parseStmt(t, s).(*StmtSelect)
+		exprs, names, err := bindColumns(schema, stmt.cols)
+		require.Nil(t, err)
+		p, err := planSelect(schema, stmt, exprs, names)
+		require.Nil(t, err)
+		return p
+	}
+
+	p := plan("select a from t where b = 2 and a = 1 and c = 3;")
+	assert.Equal(t, planPoint, p.kind)
+	assert.Equal(t, []Expr{&ExprBinary{op: "=", left: &exprCol{col: 2, name: "c"}, right: Cell{Type: TypeI64, I64: 3}}}, p.filter)
+
+	// a flipped comparison narrows the range too, an OR does not
+	p = plan("select a from t where 1 < a and (b = 1 or b = 2);")
+	assert.True(t, p.kind == planRange && len(p.scan.Start) == 1 && !p.scan.StartIncl)
+	assert.Len(t, p.filter, 1)
+
+	p = plan("select a from t where a = 1 and b > 2 and b >= 2 and c = 3;")
+	assert.Equal(t, planRange, p.kind)
+	assert.True(t, len(p.scan.Start) == 2 && !p.scan.StartIncl && len(p.scan.End) == 1)
+	assert.Len(t, p.filter, 1)
+
+	// the index narrows more than the primary key
+	p = plan("select a from t where a > 1 and c = 3;")
+	assert.True(t, p.kind == planIndex && p.index.Name == "by_c")
+	assert.Len(t, p.filter, 1)
+	p = plan("select a from t where d = 'x' and c < 3;")
+	assert.True(t, p.kind == planIndex && p.index.Name == "by_dc")
+	assert.Empty(t, p.filter)
+
+	// an index cannot give the primary key order
+	p = plan("select a from t where c = 3 order by a desc;")
+	assert.True(t, p.kind == planFull && p.scan.Reverse)
+	assert.Len(t, p.filter, 1)
+
+	p = plan("select a from t where b = 1;")
+	assert.Equal(t, planFull, p.kind)
+
+	// IN lists on the primary key become point gets in key order
+	p = plan("select a from t where a in (2, 1, 2) and b = 5 and c in (1, 2);")
+	assert.Equal(t, planPoint, p.kind)
+	assert.Equal(t, []Row{
+		{{Type: TypeI64, I64: 1}, {Type: TypeI64, I64: 5}, {}, {}},
+		{{Type: TypeI64, I64: 2}, {Type: TypeI64, I64: 5}, {}, {}},
+	}, p.points)
+	assert.Len(t, p.filter, 1)
+	p = plan("select a from t where a in (1, 2) and b > 5;")
+	assert.True(t, p.kind == planFull && len(p.filter) == 2)
+
+	// a LIKE prefix bounds the range but is still checked
+	p = plan("select a from t where d like 'ab%c' and a > 1;")
+	assert.True(t, p.kind == planIndex && p.index.Name == "by_dc")
+	assert.Equal(t, []Cell{{Type: TypeStr, Str: []byte("ab")}}, p.scan.Start)
+	assert.Equal(t, []Cell{{Type: TypeStr, Str: []byte("ac")}}, p.scan.End)
+	assert.True(t, p.scan.StartIncl && !p.scan.EndIncl)
+	assert.Len(t, p.filter, 2)
+	p = plan("select a from t where d like '\xff\xff%';")
+	assert.True(t, p.kind == planIndex && len(p.scan.End) == 0)
+	p = plan("select a from t where d like '%b';")
+	assert.Equal(t, planFull, p.kind)
+}
+
+func TestSQLPlanner(t *testing.T) {
+	db := NewDB(&MemKV{})
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	exec := func(s string) SQLResult {
+		r, err := db.ExecStmt(parseStmt(t, s))
+		require.Nil(t, err)
+		return r
+	}
+	exec("create table t (a int64, b int64, c int64, primary key (a, b));")
+	for a := 0; a < 5; a++ {
+		for b := 0; b < 5; b++ {
+			exec(fmt.Sprintf("insert into t values (%d, %d, %d);", a, b, (a*5+b)%7))
+		}
+	}
+	exec("create index by_c on t (c);")
+
+	// every access path returns what a full scan filters out
+	for _, where := range []string{
+		"a = 2 and b = 3", "a = 2 and b = 3 and c = 1", "a = 2 and b = 3 and c = 3", "a >= 3",
+		"a = 1 and b < 3", "c = 4", "c >= 2 and c < 4 and a > 1", "b = 2", "c = 9",
+		"3 > a and c != 2", "a = 2 and (b = 1 or c = 1)", "not a < 4 and b <= 2",
+		"a in (4, 0, 9) and b in (1, 3)", "a in (1, 2) and b = 3 and c != 3", "a = 1 and b in (0, 1) order by a desc",
+		"a between 1 and 3 and b not in (2)", "c between 2 and 4 and b in (0, 4)",
+	} {
+		stmt := parseStmt(t, "select a, b from t where "+where+";").(*StmtSelect)
+		conjs, err := bindWhere(&Schema{Cols: []Column{{"a", TypeI64}, {"b", TypeI64}, {"c", TypeI64}}}, stmt.where)
+		require.Nil(t, err)
+		want := []string{}
+		for _, row := range exec("select a, b, c from t;").Values {
+			if (&queryPlan{filter: conjs}).match(row) {
+				want = append(want, fmt.Sprint(row[0].I64, row[1].I64))
+			}
+		}
+		got := []string{}
+		r, err := db.ExecStmt(stmt)
+		require.Nil(t, err)
+		for _, row := range r.Values {
+			got = append(got, fmt.Sprint(row[0].I64, row[1].I64))
+		}
+		assert.ElementsMatch(t, want, got, where)
+	}
+}
@@ -3,9 +3,10 @@ package kvdb
 import "errors"
 
 type Schema struct {
-	Table string
-	Cols  []Column
-	PKey  []int // primary keys are the indexes to the Cols
+	Table   string
+	Cols    []Column
+	PKey    []int // primary keys are the indexes to the Cols
+	Indexes []Index
 }
 
 type Column struct {
@@ -33,6 +34,19 @@ func (row Row) EncodeKey(schema *Schema) (key []byte){
 	return key
 }
 
+// encodeKeyPrefix encodes the leading primary key columns in vals, which
+// sorts before every key of a row that starts with them.
+func encodeKeyPrefix(schema *Schema, vals []Cell) (key []byte) {
+	check(len(vals) <= len(schema.PKey))
+	key = append(key, []byte(schema.Table)...)
+	key = append(key, 0x00)
+	for i := range vals {
+		check(schema.Cols[schema.PKey[i]].Type == vals[i].Type)
+		key = vals[i].EncodeKey(key)
+	}
+	return key
+}
+
 func (row Row) EncodeVal(schema *Schema) (val []byte){ 
 	
 	check(len(schema.Cols) == len(row))
@@ -0,0 +1,171 @@
+package kvdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"slices"
+)
+
+// sortCol is an ORDER BY column resolved against the schema.
+type sortCol struct {
+	col  int
+	desc bool
+}
+
+// sortBufferSize is about how many bytes of rows rowSorter keeps in memory.
+var sortBufferSize = 4 << 20
+
+// rowSorter sorts rows by the ORDER BY columns. The rows are buffered in
+// memory; once the buffer is full it is sorted and written to a temp file
+// as a run, and the runs are merged at the end.
+type rowSorter struct {
+	schema *Schema
+	cols   []sortCol
+	rows   []Row
+	size   int
+	file   *os.File // the runs one after another
+	runs   []int64  // where each run ends in the file
+}
+
+func newRowSorter(schema *Schema, cols []sortCol) *rowSorter {
+	return &rowSorter{schema: schema, cols: cols}
+}
+
+func (s *rowSorter) compare(a Row, b Row) int {
+	for _, c := range s.cols {
+		r := a[c.col].Compare(&b[c.col])
+		if c.desc {
+			r = -r
+		}
+		if r != 0 {
+			return r
+		}
+	}
+	return 0
+}
+
+// Add buffers a copy of the row.
+func (s *rowSorter) Add(row Row) error {
+	s.rows = append(s.rows, slices.Clone(row))
+	for _, cell := range row {
+		s.size += 16 + len(cell.Str)
+	}
+	if s.size >= sortBufferSize {
+		return s.spill()
+	}
+	return nil
+}
+
+// spill writes the buffered rows to the temp file as a sorted run. A row
+// is its size followed by the values of its cells.
+func (s *rowSorter) spill() error {
+	if s.file == nil {
+		file, err := os.CreateTemp("", "kvdb-sort-")
+		if err != nil {
+			return err
+		}
+		s.file = file
+	}
+	slices.SortStableFunc(s.rows, s.compare)
+	w := bufio.NewWriter(s.file)
+	buf := []byte{}
+	for _, row := range s.rows {
+		buf = binary.LittleEndian.AppendUint32(buf[:0], 0)
+		for i := range row {
+			buf = row[i].EncodeVal(buf)
+		}
+		binary.LittleEndian.PutUint32(buf, uint32(len(buf)-4))
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	end, err := s.file.Seek(0, io.SeekCurrent)
+	s.runs = append(s.runs, end)
+	s.rows, s.size = nil, 0
+	return err
+}
+
+func (s *rowSorter) read(r *bufio.Reader) (Row, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	row := s.schema.NewRow()
+	for i := range row {
+		var err error
+		row[i].Type = s.schema.Cols[i].Type
+		if data, err = row[i].DecodeVal(data); err != nil {
+			return nil, err
+		}
+	}
+	return row, nil
+}
+
+// Each calls fn with the rows in order. Equal rows keep the order they
+// were added in.
+func (s *rowSorter) Each(fn func(Row) error) (err error) {
+	if s.file == nil {
+		slices.SortStableFunc(s.rows, s.compare)
+		for _, row := range s.rows {
+			if err = fn(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(s.rows) > 0 {
+		if err = s.spill(); err != nil {
+			return err
+		}
+	}
+
+	// merge the runs, the earlier one first on a tie
+	readers, heads := []*bufio.Reader{}, []Row{}
+	start := int64(0)
+	for _, end := range s.runs {
+		r := bufio.NewReader(io.NewSectionReader(s.file, start, end-start))
+		head, err := s.read(r)
+		if err != nil {
+			return err
+		}
+		readers, heads = append(readers, r), append(heads, head)
+		start = end
+	}
+	for {
+		next := -1
+		for i, row := range heads {
+			if row != nil && (next < 0 || s.compare(row, heads[next]) < 0) {
+				next = i
+			}
+		}
+		if next < 0 {
+			return nil
+		}
+		if err = fn(heads[next]); err != nil {
+			return err
+		}
+		if heads[next], err = s.read(readers[next]); err != nil {
+			return err
+		}
+	}
+}
+
+// Close removes the temp file.
+func (s *rowSorter) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
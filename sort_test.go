@@ -0,0 +1,51 @@
+package kvdb
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRowSorter(t *testing.T) {
+	schema := &Schema{Cols: []Column{{"a", TypeI64}, {"b", TypeStr}, {"i", TypeI64}}}
+	rows := []Row{}
+	for i := 0; i < 1000; i++ {
+		rows = append(rows, Row{
+			{Type: TypeI64, I64: int64(rand.Intn(10))},
+			{Type: TypeStr, Str: []byte(fmt.Sprint(rand.Intn(10)))},
+			{Type: TypeI64, I64: int64(i)},
+		})
+	}
+	cols := []sortCol{{col: 1, desc: true}, {col: 0}}
+	want := slices.Clone(rows)
+	slices.SortStableFunc(want, (&rowSorter{cols: cols}).compare)
+
+	defer func(size int) { sortBufferSize = size }(sortBufferSize)
+	for _, size := range []int{1 << 20, 1000, 1} {
+		sortBufferSize = size
+		s := newRowSorter(schema, cols)
+		for _, row := range rows {
+			require.Nil(t, s.Add(row))
+		}
+		assert.Equal(t, size < 1<<20, s.file != nil)
+
+		got := []Row{}
+		require.Nil(t, s.Each(func(row Row) error {
+			got = append(got, row)
+			return nil
+		}))
+		assert.Equal(t, want, got)
+
+		if s.file != nil {
+			name := s.file.Name()
+			require.Nil(t, s.Close())
+			_, err := os.Stat(name)
+			assert.True(t, os.IsNotExist(err))
+		}
+	}
+}
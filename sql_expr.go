@@ -0,0 +1,428 @@
+package kvdb
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+A WHERE clause is an expression tree. The parser builds it out of column
+names and constant Cells; bindExpr then resolves the names against the
+schema and checks the types, and evalExpr computes it for a row. Truth
+values are TypeI64 cells, 1 or 0.
+
+Precedence from low to high: OR, AND, NOT, comparisons. The comparisons
+include `x [NOT] IN (...)`, `x [NOT] BETWEEN a AND b`, which is short for
+`x >= a AND x <= b`, `x [NOT] LIKE pattern` and `x IS [NOT] NULL`.
+*/
+
+type Expr interface{}
+
+type ExprColumn struct {
+	name string
+}
+
+// ExprBinary is a comparison (= != < <= > >=), AND or OR.
+type ExprBinary struct {
+	op    string
+	left  Expr
+	right Expr
+}
+
+type ExprNot struct {
+	expr Expr
+}
+
+type ExprIn struct {
+	expr Expr
+	list []Expr
+}
+
+// ExprLike matches a string pattern where `%` stands for any characters
+// and `_` for one UTF-8 character.
+type ExprLike struct {
+	expr    Expr
+	pattern Expr
+}
+
+// ExprIsNull tests for a cell without a type. Cells have no NULL value
+// yet, so no column is NULL: only an aggregate over no rows is.
+type ExprIsNull struct {
+	expr Expr
+}
+
+// exprCol is a column resolved by bindExpr.
+type exprCol struct {
+	col  int
+	name string
+}
+
+var compareOps = []string{"<=", ">=", "!=", "<>", "<", ">", "="}
+
+func (p *Parser) parseExpr() (Expr, error) {
+	return p.parseOr()
+}
+
+func (p *Parser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.tryKeyword("OR") {
+		var right Expr
+		if right, err = p.parseAnd(); err == nil {
+			left = &ExprBinary{op: "OR", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *Parser) parseAnd() (Expr, error) {
+	left, err := p.parseNot()
+	for err == nil && p.tryKeyword("AND") {
+		var right Expr
+		if right, err = p.parseNot(); err == nil {
+			left = &ExprBinary{op: "AND", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *Parser) parseNot() (Expr, error) {
+	if p.tryKeyword("NOT") {
+		expr, err := p.parseNot()
+		return &ExprNot{expr: expr}, err
+	}
+	return p.parseCmp()
+}
+
+func (p *Parser) parseCmp() (Expr, error) {
+	left, err := p.parseAtom()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range compareOps {
+		if p.tryPunctuation(op) {
+			right, err := p.parseAtom()
+			if op == "<>" {
+				op = "!="
+			}
+			return &ExprBinary{op: op, left: left, right: right}, err
+		}
+	}
+	if p.tryKeyword("IS") {
+		not := p.tryKeyword("NOT")
+		if !p.tryKeyword("NULL") {
+			return nil, errors.New("expect NULL")
+		}
+		return negate(&ExprIsNull{expr: left}, not), nil
+	}
+
+	not := p.tryKeyword("NOT")
+	var expr Expr
+	switch {
+	case p.tryKeyword("IN"):
+		in := &ExprIn{expr: left}
+		if !p.tryPunctuation("(") {
+			return nil, errors.New("expect (")
+		}
+		for len(in.list) == 0 || !p.tryPunctuation(")") {
+			if len(in.list) > 0 && !p.tryPunctuation(",") {
+				return nil, errors.New("expect comma")
+			}
+			item, err := p.parseAtom()
+			if err != nil {
+				return nil, err
+			}
+			in.list = append(in.list, item)
+		}
+		expr = in
+	case p.tryKeyword("BETWEEN"):
+		lo, err := p.parseAtom()
+		if err != nil {
+			return nil, err
+		}
+		if !p.tryKeyword("AND") {
+			return nil, errors.New("expect AND")
+		}
+		hi, err := p.parseAtom()
+		if err != nil {
+			return nil, err
+		}
+		expr = &ExprBinary{op: "AND",
+			left:  &ExprBinary{op: ">=", left: left, right: lo},
+			right: &ExprBinary{op: "<=", left: left, right: hi},
+		}
+	case p.tryKeyword("LIKE"):
+		pattern, err := p.parseAtom()
+		if err != nil {
+			return nil, err
+		}
+		expr = &ExprLike{expr: left, pattern: pattern}
+	case not:
+		return nil, errors.New("expect IN, BETWEEN or LIKE")
+	default:
+		return left, nil
+	}
+	return negate(expr, not), nil
+}
+
+func negate(expr Expr, not bool) Expr {
+	if not {
+		return &ExprNot{expr: expr}
+	}
+	return expr
+}
+
+func (p *Parser) parseAtom() (Expr, error) {
+	if p.tryPunctuation("(") {
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.tryPunctuation(")") {
+			return nil, errors.New("expect )")
+		}
+		return expr, nil
+	}
+	if p.isEnd() {
+		return nil, errors.New("expect expression")
+	}
+	if name, ok := p.tryName(); ok {
+		if p.tryPunctuation("(") {
+			return p.parseCall(name)
+		}
+		return &ExprColumn{name: name}, nil
+	}
+	var cell Cell
+	if err := p.parseValue(&cell); err != nil {
+		return nil, errors.New("expect expression")
+	}
+	return cell, nil
+}
+
+// bindExpr resolves the columns of the expression and checks its types.
+func bindExpr(schema *Schema, expr Expr) (Expr, CellType, error) {
+	switch e := expr.(type) {
+	case Cell:
+		return e, e.Type, nil
+	case *ExprColumn:
+		col, err := lookupColumns(schema.Cols, []string{e.name})
+		if err != nil {
+			return nil, 0, err
+		}
+		return &exprCol{col: col[0], name: schema.Cols[col[0]].Name}, schema.Cols[col[0]].Type, nil
+	case *ExprNot:
+		inner, typ, err := bindExpr(schema, e.expr)
+		if err == nil && typ != TypeI64 {
+			err = errors.New("NOT expects a truth value")
+		}
+		return &ExprNot{expr: inner}, TypeI64, err
+	case *ExprIn:
+		inner, typ, err := bindExpr(schema, e.expr)
+		if err != nil {
+			return nil, 0, err
+		}
+		out := &ExprIn{expr: inner}
+		for _, item := range e.list {
+			item, ityp, err := bindExpr(schema, item)
+			if err != nil {
+				return nil, 0, err
+			}
+			if ityp != typ {
+				return nil, 0, errors.New("type mismatch in IN")
+			}
+			out.list = append(out.list, item)
+		}
+		return out, TypeI64, nil
+	case *ExprLike:
+		inner, typ, err := bindExpr(schema, e.expr)
+		if err != nil {
+			return nil, 0, err
+		}
+		pattern, ptyp, err := bindExpr(schema, e.pattern)
+		if err != nil {
+			return nil, 0, err
+		}
+		if typ != TypeStr || ptyp != TypeStr {
+			return nil, 0, errors.New("LIKE expects strings")
+		}
+		return &ExprLike{expr: inner, pattern: pattern}, TypeI64, nil
+	case *ExprIsNull:
+		inner, _, err := bindExpr(schema, e.expr)
+		return &ExprIsNull{expr: inner}, TypeI64, err
+	case *ExprCall:
+		return bindCall(schema, e)
+	case *ExprBinary:
+		left, ltyp, err := bindExpr(schema, e.left)
+		if err != nil {
+			return nil, 0, err
+		}
+		right, rtyp, err := bindExpr(schema, e.right)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ltyp != rtyp || ((e.op == "AND" || e.op == "OR") && ltyp != TypeI64) {
+			return nil, 0, errors.New("type mismatch in " + e.op)
+		}
+		return &ExprBinary{op: e.op, left: left, right: right}, TypeI64, nil
+	default:
+		panic("unreachable")
+	}
+}
+
+// evalExpr computes a bound expression for the row.
+func evalExpr(expr Expr, row Row) Cell {
+	switch e := expr.(type) {
+	case Cell:
+		return e
+	case *exprCol:
+		return row[e.col]
+	case *ExprNot:
+		return truth(!isTrue(evalExpr(e.expr, row)))
+	case *ExprIn:
+		val := evalExpr(e.expr, row)
+		for _, item := range e.list {
+			if cell := evalExpr(item, row); val.Type != 0 && cell.Type != 0 && val.Compare(&cell) == 0 {
+				return truth(true)
+			}
+		}
+		return truth(false)
+	case *ExprLike:
+		return truth(likeMatch(evalExpr(e.expr, row).Str, evalExpr(e.pattern, row).Str))
+	case *ExprIsNull:
+		return truth(evalExpr(e.expr, row).Type == 0)
+	case *ExprBinary:
+		switch e.op {
+		case "AND":
+			return truth(isTrue(evalExpr(e.left, row)) && isTrue(evalExpr(e.right, row)))
+		case "OR":
+			return truth(isTrue(evalExpr(e.left, row)) || isTrue(evalExpr(e.right, row)))
+		}
+		left, right := evalExpr(e.left, row), evalExpr(e.right, row)
+		// nothing compares with a NULL
+		if left.Type == 0 || right.Type == 0 {
+			return truth(false)
+		}
+		return truth(compareOp(e.op, left.Compare(&right)))
+	default:
+		panic("unreachable")
+	}
+}
+
+// compareOp applies a comparison to the result of Cell.Compare.
+func compareOp(op string, r int) bool {
+	switch op {
+	case "=":
+		return r == 0
+	case "!=":
+		return r != 0
+	case "<":
+		return r < 0
+	case "<=":
+		return r <= 0
+	case ">":
+		return r > 0
+	case ">=":
+		return r >= 0
+	default:
+		panic("unreachable")
+	}
+}
+
+func truth(b bool) Cell {
+	if b {
+		return Cell{Type: TypeI64, I64: 1}
+	}
+	return Cell{Type: TypeI64, I64: 0}
+}
+
+func isTrue(cell Cell) bool { return cell.Type == TypeI64 && cell.I64 != 0 }
+
+// likeMatch matches s against a LIKE pattern. On a mismatch it retries
+// from the last `%` with one more character consumed by it.
+func likeMatch(s []byte, pattern []byte) bool {
+	i, j := 0, 0
+	star, mark := -1, 0
+	for i < len(s) {
+		switch {
+		case j < len(pattern) && pattern[j] == '%':
+			star, mark = j, i
+			j++
+		case j < len(pattern) && pattern[j] == '_':
+			_, size := utf8.DecodeRune(s[i:])
+			i += size
+			j++
+		case j < len(pattern) && pattern[j] == s[i]:
+			i++
+			j++
+		case star >= 0:
+			_, size := utf8.DecodeRune(s[mark:])
+			mark += size
+			i, j = mark, star+1
+		default:
+			return false
+		}
+	}
+	for j < len(pattern) && pattern[j] == '%' {
+		j++
+	}
+	return j == len(pattern)
+}
+
+// likePrefix returns the bytes every match of the pattern starts with.
+func likePrefix(pattern []byte) []byte {
+	for i, c := range pattern {
+		if c == '%' || c == '_' {
+			return pattern[:i]
+		}
+	}
+	return pattern
+}
+
+// formatExpr writes a bound expression as SQL.
+func formatExpr(expr Expr) string {
+	switch e := expr.(type) {
+	case Cell:
+		return formatCell(&e)
+	case *exprCol:
+		return e.name
+	case *ExprNot:
+		return "NOT " + formatOperand(e.expr)
+	case *ExprIn:
+		items := []string{}
+		for _, item := range e.list {
+			items = append(items, formatOperand(item))
+		}
+		return formatOperand(e.expr) + " IN (" + strings.Join(items, ", ") + ")"
+	case *ExprLike:
+		return formatOperand(e.expr) + " LIKE " + formatOperand(e.pattern)
+	case *ExprIsNull:
+		return formatOperand(e.expr) + " IS NULL"
+	case *exprAgg:
+		if e.arg == nil {
+			return e.name + "(*)"
+		}
+		return e.name + "(" + formatExpr(e.arg) + ")"
+	case *ExprBinary:
+		return formatOperand(e.left) + " " + e.op + " " + formatOperand(e.right)
+	default:
+		panic("unreachable")
+	}
+}
+
+func formatOperand(expr Expr) string {
+	if e, ok := expr.(*ExprBinary); ok && (e.op == "AND" || e.op == "OR") {
+		return "(" + formatExpr(e) + ")"
+	}
+	return formatExpr(expr)
+}
+
+// conjuncts splits an expression at its top level ANDs.
+func conjuncts(expr Expr) []Expr {
+	if e, ok := expr.(*ExprBinary); ok && e.op == "AND" {
+		return append(conjuncts(e.left), conjuncts(e.right)...)
+	}
+	if expr == nil {
+		return nil
+	}
+	return []Expr{expr}
+}
@@ -0,0 +1,136 @@
+package kvdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExpr(t *testing.T) {
+	schema := &Schema{Cols: []Column{{"a", TypeI64}, {"b", TypeI64}, {"c", TypeStr}}}
+	bind := func(s string) (Expr, error) {
+		p := NewParser(s)
+		expr, err := p.parseExpr()
+		require.Nil(t, err)
+		require.True(t, p.isEnd(), s)
+		expr, _, err = bindExpr(schema, expr)
+		return expr, err
+	}
+	format := func(s string) string {
+		expr, err := bind(s)
+		require.Nil(t, err)
+		return formatExpr(expr)
+	}
+
+	// OR < AND < NOT < comparisons
+	assert.Equal(t, "a = 1 OR (NOT b < 2 AND c != 'x')", format("a = 1 or not b < 2 and c <> 'x'"))
+	assert.Equal(t, "(a = 1 OR b >= 2) AND c = 'x'", format("(a = 1 or b>=2) and (c = 'x')"))
+	assert.Equal(t, "NOT (a <= 1 AND b > 2)", format("not (a <= 1 and b > 2)"))
+	assert.Equal(t, "(a = 1 AND b = 2) AND 3 = a", format("a = 1 and b = 2 and 3 = a"))
+	assert.Equal(t, "a IN (1, 2) OR NOT b IN (3)", format("a in (1, 2) or b not in (3)"))
+	assert.Equal(t, "(a >= 1 AND a <= b) AND c = 'x'", format("a between 1 and b and c = 'x'"))
+	assert.Equal(t, "NOT (a >= 1 AND a <= 2)", format("a not between 1 and 2"))
+	assert.Equal(t, "c LIKE 'a%' AND NOT c LIKE '_'", format("c like 'a%' and c not like '_'"))
+	assert.Equal(t, "a IS NULL OR NOT c IS NULL", format("a is null or c is not null"))
+	assert.Equal(t, "SUM(a) IS NULL OR NOT MAX(c) IS NULL", format("sum(a) is null or max(c) is not null"))
+
+	for _, s := range []string{"a = 'x'", "a = 1 and c", "not c", "d = 1", "(a = 1) = 'x'",
+		"a in (1, 'x')", "a like 'x'", "c like 1", "c in (d)"} {
+		_, err := bind(s)
+		assert.NotNil(t, err, s)
+	}
+	for _, s := range []string{"a = ", "(a = 1", "a = 1 and", "not", "a in ()", "a in (1", "a between 1",
+		"a not = 1", "a is not 1", "c not"} {
+		p := NewParser(s)
+		_, err := p.parseExpr()
+		assert.NotNil(t, err, s)
+	}
+
+	eval := func(s string, row Row) bool {
+		expr, err := bind(s)
+		require.Nil(t, err)
+		return isTrue(evalExpr(expr, row))
+	}
+	row := Row{{Type: TypeI64, I64: 1}, {Type: TypeI64, I64: 2}, {Type: TypeStr, Str: []byte("x")}}
+	assert.True(t, eval("a = 1 and b != 1", row))
+	assert.True(t, eval("a > 1 or c = 'x'", row))
+	assert.False(t, eval("not (a < b)", row))
+	assert.True(t, eval("not a >= b and c <= 'x'", row))
+	assert.False(t, eval("a = 1 and (b = 1 or c = 'y')", row))
+	assert.True(t, eval("a in (3, 2, 1) and b not in (1, 3)", row))
+	assert.True(t, eval("b between a and 2 and not a between 2 and 3", row))
+	assert.True(t, eval("c like 'x' and c like '%' and c like '_%' and c not like 'x_'", row))
+	assert.False(t, eval("c is null or a is null", row))
+	assert.True(t, eval("c is not null", row))
+}
+
+func TestLike(t *testing.T) {
+	for _, c := range []struct {
+		s, pattern string
+		match      bool
+	}{
+		{"", "", true}, {"", "%", true}, {"", "_", false}, {"abc", "abc", true}, {"abc", "ab", false},
+		{"abc", "a%", true}, {"abc", "%c", true}, {"abc", "%b%", true}, {"abc", "a_c", true},
+		{"abc", "a_", false}, {"abc", "%%c%", true}, {"aXbXc", "a%b%c", true}, {"abcbd", "%b_", true},
+		{"abcbd", "%bc", false}, {"a%b", "a%%b", true}, {"ab", "a%b%c", false},
+		// _ is one character, not one byte
+		{"é", "_", true}, {"aéb", "a_b", true}, {"aéb", "a__b", false}, {"日本", "%_本", true},
+	} {
+		assert.Equal(t, c.match, likeMatch([]byte(c.s), []byte(c.pattern)), c.s+" LIKE "+c.pattern)
+	}
+	assert.Equal(t, "ab", string(likePrefix([]byte("ab_c%"))))
+	assert.Equal(t, "abc", string(likePrefix([]byte("abc"))))
+	assert.Empty(t, likePrefix([]byte("%a")))
+}
+
+func TestSQLExpr(t *testing.T) {
+	db := NewDB(&MemKV{})
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	exec := func(s string) SQLResult {
+		r, err := db.ExecStmt(parseStmt(t, s))
+		require.Nil(t, err)
+		return r
+	}
+	query := func(s string) []string {
+		got := []string{}
+		for _, row := range exec(s).Values {
+			got = append(got, fmt.Sprintf("%d%d", row[0].I64, row[1].I64))
+		}
+		return got
+	}
+	exec("create table t (a int64, b int64, v string, primary key (a, b));")
+	for a := 0; a < 3; a++ {
+		for b := 0; b < 3; b++ {
+			exec(fmt.Sprintf("insert into t values (%d, %d, 'x%d');", a, b, b))
+		}
+	}
+
+	assert.Equal(t, []string{"00", "01", "02", "11", "21"}, query("select a, b from t where a = 0 or b = 1;"))
+	assert.Equal(t, []string{"10", "12"}, query("select a, b from t where a = 1 and not b = 1;"))
+	assert.Equal(t, []string{"01", "21"}, query("select a, b from t where (a < 1 or a > 1) and v = 'x1';"))
+	assert.Equal(t, []string{"02", "12", "20", "21", "22"}, query("select a, b from t where a = 2 or b = 2 and a != b;"))
+
+	assert.Equal(t, []string{"02", "10", "20"}, query("select a, b from t where a in (0, 1, 2) and b in (2, 0) and a != b and not (a = 1 and b = 2);"))
+	assert.Equal(t, []string{"11", "12", "21", "22"}, query("select a, b from t where a between 1 and 2 and b not between -5 and 0;"))
+	assert.Equal(t, []string{"01", "11", "21"}, query("select a, b from t where v like 'x1%' and v not like '_0';"))
+	assert.Empty(t, query("select a, b from t where v is null;"))
+	assert.Len(t, query("select a, b from t where v is not null;"), 9)
+	assert.Empty(t, query("select a, b from t where a is null and b = 1;"))
+
+	// many rows at once
+	assert.Equal(t, 3, exec("update t set v = 'y' where b = 1 or v = 'nope';").Updated)
+	assert.Equal(t, []string{"01", "11", "21"}, query("select a, b from t where v = 'y';"))
+	assert.Equal(t, 4, exec("delete from t where a >= 1 and b != 1;").Updated)
+	assert.Equal(t, []string{"00", "01", "02", "11", "21"}, query("select a, b from t;"))
+	assert.Equal(t, 5, exec("delete from t;").Updated)
+	assert.Empty(t, query("select a, b from t;"))
+
+	_, err := db.ExecStmt(parseStmt(t, "update t set a = 1 where b = 1;"))
+	assert.NotNil(t, err)
+	_, err = db.ExecStmt(parseStmt(t, "delete from t where v = 1;"))
+	assert.NotNil(t, err)
+}
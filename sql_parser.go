@@ -12,9 +12,23 @@ type Parser struct {
 }
 
 type StmtSelect struct {
-	table string
-	cols  []string
-	keys  []NamedCell
+	distinct bool
+	table    string
+	cols     []SelectItem
+	where    Expr // nil without a WHERE clause
+	group    []string
+	having   Expr
+	order    []OrderBy
+	// LIMIT and OFFSET
+	limit    int64
+	hasLimit bool
+	offset   int64
+}
+
+// SelectItem is an output column, or every column of the table for `*`.
+type SelectItem struct {
+	expr  Expr // nil for `*`
+	alias string
 }
 
 type NamedCell struct {
@@ -22,12 +36,29 @@ type NamedCell struct {
 	value  Cell
 }
 
+type OrderBy struct {
+	column string
+	desc   bool
+}
+
 type StmtCreatTable struct {
 	table string
 	cols  []Column
 	pkey  []string
 }
 
+type StmtCreateIndex struct {
+	name   string
+	table  string
+	cols   []string
+	unique bool
+}
+
+type StmtDropIndex struct {
+	name  string
+	table string
+}
+
 type StmtInsert struct {
 	table string
 	value []Cell
@@ -35,15 +66,26 @@ type StmtInsert struct {
 
 type StmtUpdate struct {
 	table string
-	keys  []NamedCell
+	where Expr
 	value []NamedCell
 }
 
 type StmtDelete struct {
 	table string
-	keys  []NamedCell
+	where Expr
+}
+
+type StmtExplain struct {
+	stmt    *StmtSelect
+	analyze bool // run the query for its statistics
 }
 
+type StmtBegin struct{}
+
+type StmtCommit struct{}
+
+type StmtRollback struct{}
+
 func NewParser(s string) Parser {
 	return Parser{buf: s, pos: 0}
 }
@@ -129,7 +171,7 @@ func (p *Parser) tryName() (string, bool) {
 	p.skipSpaces()
 	startPos := p.pos
 
-	if !isNameStart(p.buf[p.pos]) {
+	if p.pos >= len(p.buf) || !isNameStart(p.buf[p.pos]) {
 		p.pos = initialPos
 		return "", false
 	}
@@ -230,15 +272,17 @@ func (p *Parser) parseEqual(out *NamedCell) error {
 }
 
 func (p *Parser) parseSelect(out *StmtSelect) error {
+	star := "" // the table of a `t.*`
+	out.distinct = p.tryKeyword("DISTINCT")
 	for !p.tryKeyword("FROM") {
 		if len(out.cols) > 0 && !p.tryPunctuation(",") {
 			return errors.New("expect comma")
 		}
-		if name, ok := p.tryName(); ok {
-			out.cols = append(out.cols, name)
-		} else {
-			return errors.New("expect column")
+		var item SelectItem
+		if err := p.parseSelectItem(&item, &star); err != nil {
+			return err
 		}
+		out.cols = append(out.cols, item)
 	}
 
 	if len(out.cols) == 0 {
@@ -250,32 +294,118 @@ func (p *Parser) parseSelect(out *StmtSelect) error {
 	if out.table, ok = p.tryName(); !ok {
 		return errors.New("expect table name")
 	}
+	if star != "" && star != out.table {
+		return errors.New("table " + star + " is not in FROM")
+	}
 
-	return p.parseWhere(&out.keys)
+	if err := p.parseWhere(&out.where); err != nil {
+		return err
+	}
+	if p.tryKeyword("GROUP", "BY") {
+		for len(out.group) == 0 || p.tryPunctuation(",") {
+			name, ok := p.tryName()
+			if !ok {
+				return errors.New("expect column")
+			}
+			out.group = append(out.group, name)
+		}
+	}
+	if p.tryKeyword("HAVING") {
+		var err error
+		if out.having, err = p.parseExpr(); err != nil {
+			return err
+		}
+	}
+	if p.tryKeyword("ORDER", "BY") {
+		if err := p.parseOrder(&out.order); err != nil {
+			return err
+		}
+	}
+	if p.tryKeyword("LIMIT") {
+		out.hasLimit = true
+		if err := p.parseCount(&out.limit); err != nil {
+			return err
+		}
+	}
+	if p.tryKeyword("OFFSET") {
+		if err := p.parseCount(&out.offset); err != nil {
+			return err
+		}
+	}
+	return p.parseEnd()
 }
 
-func (p *Parser) parseWhere(out *[]NamedCell) error {
-	if !p.tryKeyword("WHERE") {
-		return errors.New("expect keyword WHERE")
+// parseCount parses a non-negative integer.
+func (p *Parser) parseCount(out *int64) error {
+	var cell Cell
+	if err := p.parseValue(&cell); err != nil || cell.Type != TypeI64 || cell.I64 < 0 {
+		return errors.New("expect a count")
 	}
+	*out = cell.I64
+	return nil
+}
 
-	for !p.tryPunctuation(";") {
-		if len(*out) > 0 && !p.tryKeyword("AND") {
-			return errors.New("expect AND")
+// parseSelectItem parses `*`, `t.*` with t stored in star, or
+// `expr [AS alias]`.
+func (p *Parser) parseSelectItem(out *SelectItem, star *string) (err error) {
+	if p.tryPunctuation("*") {
+		return nil
+	}
+	if p.isEnd() {
+		return errors.New("expect column")
+	}
+	pos := p.pos
+	if name, ok := p.tryName(); ok && p.tryPunctuation(".") {
+		if !p.tryPunctuation("*") {
+			return errors.New("expect *")
 		}
-		var res NamedCell
-		if err := p.parseEqual(&res); err != nil {
-			return err
+		if *star != "" && *star != name {
+			return errors.New("expect one table")
 		}
-		*out = append(*out, res)
-	}
-	if len(*out) == 0 {
-		return errors.New("expect WHERE clause")
+		*star = name
+		return nil
 	}
+	p.pos = pos
 
+	if out.expr, err = p.parseExpr(); err != nil {
+		return err
+	}
+	if p.tryKeyword("AS") {
+		var ok bool
+		if out.alias, ok = p.tryName(); !ok {
+			return errors.New("expect alias")
+		}
+	}
 	return nil
 }
 
+func (p *Parser) parseOrder(out *[]OrderBy) error {
+	for {
+		var res OrderBy
+		var ok bool
+		if res.column, ok = p.tryName(); !ok {
+			return errors.New("expect column")
+		}
+		if p.tryKeyword("DESC") {
+			res.desc = true
+		} else {
+			p.tryKeyword("ASC")
+		}
+		*out = append(*out, res)
+		if !p.tryPunctuation(",") {
+			return nil
+		}
+	}
+}
+
+// parseWhere parses an optional WHERE clause, no clause selects every row.
+func (p *Parser) parseWhere(out *Expr) (err error) {
+	if p.tryKeyword("WHERE") {
+		*out, err = p.parseExpr()
+	}
+	return err
+}
+
 func (p *Parser) parseCreateTable(out *StmtCreatTable) error {
 	var ok bool 
 	if out.table, ok = p.tryName(); !ok {
@@ -348,6 +478,50 @@ func (p *Parser) parseCreateTable(out *StmtCreatTable) error {
 	return nil 
 }
 
+func (p *Parser) parseCreateIndex(out *StmtCreateIndex) error {
+	var ok bool
+	if out.name, ok = p.tryName(); !ok {
+		return errors.New("CREATE INDEX: expect index name")
+	}
+	if !p.tryKeyword("ON") {
+		return errors.New("CREATE INDEX: expect ON")
+	}
+	if out.table, ok = p.tryName(); !ok {
+		return errors.New("CREATE INDEX: expect table name")
+	}
+	if !p.tryPunctuation("(") {
+		return errors.New("CREATE INDEX: expect (")
+	}
+	for !p.tryPunctuation(")") {
+		if len(out.cols) > 0 && !p.tryPunctuation(",") {
+			return errors.New("CREATE INDEX: expect comma")
+		}
+		col, ok := p.tryName()
+		if !ok {
+			return errors.New("CREATE INDEX: expect column")
+		}
+		out.cols = append(out.cols, col)
+	}
+	if len(out.cols) == 0 {
+		return errors.New("CREATE INDEX: expect column list")
+	}
+	return p.parseEnd()
+}
+
+func (p *Parser) parseDropIndex(out *StmtDropIndex) error {
+	var ok bool
+	if out.name, ok = p.tryName(); !ok {
+		return errors.New("DROP INDEX: expect index name")
+	}
+	if !p.tryKeyword("ON") {
+		return errors.New("DROP INDEX: expect ON")
+	}
+	if out.table, ok = p.tryName(); !ok {
+		return errors.New("DROP INDEX: expect table name")
+	}
+	return p.parseEnd()
+}
+
 func (p *Parser) parseInsert(out *StmtInsert) error {
 	var ok bool 
 	if out.table, ok = p.tryName(); !ok {
@@ -399,7 +573,10 @@ func (p *Parser) parseUpdate(out *StmtUpdate) error {
 		}
 	}
 
-	return p.parseWhere(&out.keys)
+	if err := p.parseWhere(&out.where); err != nil {
+		return err
+	}
+	return p.parseEnd()
 }
 
 func (p *Parser) parseDelete(out *StmtDelete) error {
@@ -407,7 +584,17 @@ func (p *Parser) parseDelete(out *StmtDelete) error {
 	if out.table, ok = p.tryName(); !ok {
 		return errors.New("DELETE: error parsing table name")
 	}
-	return p.parseWhere(&out.keys)
+	if err := p.parseWhere(&out.where); err != nil {
+		return err
+	}
+	return p.parseEnd()
+}
+
+func (p *Parser) parseEnd() error {
+	if !p.tryPunctuation(";") {
+		return errors.New("expect ;")
+	}
+	return nil
 }
 
 func (p *Parser) parseStmt() (out interface{}, err error) {
@@ -415,10 +602,30 @@ func (p *Parser) parseStmt() (out interface{}, err error) {
 		stmt := &StmtSelect{}
 		err = p.parseSelect(stmt)
 		out = stmt
+	} else if p.tryKeyword("EXPLAIN") {
+		stmt := &StmtExplain{stmt: &StmtSelect{}}
+		stmt.analyze = p.tryKeyword("ANALYZE")
+		if !p.tryKeyword("SELECT") {
+			return nil, errors.New("EXPLAIN: expect SELECT")
+		}
+		err = p.parseSelect(stmt.stmt)
+		out = stmt
 	} else if p.tryKeyword("CREATE", "TABLE") {
 		stmt := &StmtCreatTable{}
 		err = p.parseCreateTable(stmt)
 		out = stmt
+	} else if p.tryKeyword("CREATE", "INDEX") {
+		stmt := &StmtCreateIndex{}
+		err = p.parseCreateIndex(stmt)
+		out = stmt
+	} else if p.tryKeyword("CREATE", "UNIQUE", "INDEX") {
+		stmt := &StmtCreateIndex{unique: true}
+		err = p.parseCreateIndex(stmt)
+		out = stmt
+	} else if p.tryKeyword("DROP", "INDEX") {
+		stmt := &StmtDropIndex{}
+		err = p.parseDropIndex(stmt)
+		out = stmt
 	} else if p.tryKeyword("INSERT", "INTO") {
 		stmt := &StmtInsert{}
 		err = p.parseInsert(stmt)
@@ -431,6 +638,13 @@ func (p *Parser) parseStmt() (out interface{}, err error) {
 		stmt := &StmtDelete{}
 		err = p.parseDelete(stmt)
 		out = stmt
+	} else if p.tryKeyword("BEGIN") {
+		p.tryKeyword("TRANSACTION")
+		out, err = &StmtBegin{}, p.parseEnd()
+	} else if p.tryKeyword("COMMIT") {
+		out, err = &StmtCommit{}, p.parseEnd()
+	} else if p.tryKeyword("ROLLBACK") {
+		out, err = &StmtRollback{}, p.parseEnd()
 	} else {
 		err = errors.New("unknown statement")
 	}
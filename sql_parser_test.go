@@ -55,18 +55,18 @@ func TestParseStmt(t *testing.T) {
 	s := "select a from t where c=1;"
 	stmt = &StmtSelect{
 		table: "t",
-		cols:  []string{"a"},
-		keys:  []NamedCell{{column: "c", value: Cell{Type: TypeI64, I64: 1}}},
+		cols:  []SelectItem{{expr: &ExprColumn{"a"}}},
+		where: &ExprBinary{op: "=", left: &ExprColumn{"c"}, right: Cell{Type: TypeI64, I64: 1}},
 	}
 	testParseStmt(t, s, stmt)
 
 	s = "select a,b_02 from T where c=1 and d='e';"
 	stmt = &StmtSelect{
 		table: "T",
-		cols:  []string{"a", "b_02"},
-		keys: []NamedCell{
-			{column: "c", value: Cell{Type: TypeI64, I64: 1}},
-			{column: "d", value: Cell{Type: TypeStr, Str: []byte("e")}},
+		cols:  []SelectItem{{expr: &ExprColumn{"a"}}, {expr: &ExprColumn{"b_02"}}},
+		where: &ExprBinary{op: "AND",
+			left:  &ExprBinary{op: "=", left: &ExprColumn{"c"}, right: Cell{Type: TypeI64, I64: 1}},
+			right: &ExprBinary{op: "=", left: &ExprColumn{"d"}, right: Cell{Type: TypeStr, Str: []byte("e")}},
 		},
 	}
 	testParseStmt(t, s, stmt)
@@ -77,14 +77,75 @@ func TestParseStmt(t *testing.T) {
 	s = "select a,b_02 from T where c='b' and d='e';"
 	stmt = &StmtSelect{
 		table: "T",
-		cols:  []string{"a", "b_02"},
-		keys: []NamedCell{
-			{column: "c", value: Cell{Type: TypeStr, Str: []byte("b")}},
-			{column: "d", value: Cell{Type: TypeStr, Str: []byte("e")}},
+		cols:  []SelectItem{{expr: &ExprColumn{"a"}}, {expr: &ExprColumn{"b_02"}}},
+		where: &ExprBinary{op: "AND",
+			left:  &ExprBinary{op: "=", left: &ExprColumn{"c"}, right: Cell{Type: TypeStr, Str: []byte("b")}},
+			right: &ExprBinary{op: "=", left: &ExprColumn{"d"}, right: Cell{Type: TypeStr, Str: []byte("e")}},
 		},
 	}
 	testParseStmt(t, s, stmt)
 
+	s = "select a from t;"
+	stmt = &StmtSelect{table: "t", cols: []SelectItem{{expr: &ExprColumn{"a"}}}}
+	testParseStmt(t, s, stmt)
+
+	s = "select a from t where b = 1 and c >= 2 and c<'x';"
+	stmt = &StmtSelect{
+		table: "t",
+		cols:  []SelectItem{{expr: &ExprColumn{"a"}}},
+		where: &ExprBinary{op: "AND",
+			left: &ExprBinary{op: "AND",
+				left:  &ExprBinary{op: "=", left: &ExprColumn{"b"}, right: Cell{Type: TypeI64, I64: 1}},
+				right: &ExprBinary{op: ">=", left: &ExprColumn{"c"}, right: Cell{Type: TypeI64, I64: 2}},
+			},
+			right: &ExprBinary{op: "<", left: &ExprColumn{"c"}, right: Cell{Type: TypeStr, Str: []byte("x")}},
+		},
+	}
+	testParseStmt(t, s, stmt)
+
+	s = "select a from t order by a desc, b asc, c;"
+	stmt = &StmtSelect{
+		table: "t",
+		cols:  []SelectItem{{expr: &ExprColumn{"a"}}},
+		order: []OrderBy{{column: "a", desc: true}, {column: "b"}, {column: "c"}},
+	}
+	testParseStmt(t, s, stmt)
+
+	s = "select *, t.*, a as x, b = 1 AS y from t;"
+	stmt = &StmtSelect{
+		table: "t",
+		cols: []SelectItem{
+			{}, {}, {expr: &ExprColumn{"a"}, alias: "x"},
+			{expr: &ExprBinary{op: "=", left: &ExprColumn{"b"}, right: Cell{Type: TypeI64, I64: 1}}, alias: "y"},
+		},
+	}
+	testParseStmt(t, s, stmt)
+
+	s = "select a from t order by a limit 10 offset 0;"
+	stmt = &StmtSelect{
+		table: "t", cols: []SelectItem{{expr: &ExprColumn{"a"}}}, order: []OrderBy{{column: "a"}},
+		limit: 10, hasLimit: true,
+	}
+	testParseStmt(t, s, stmt)
+	s = "select a from t offset 5;"
+	stmt = &StmtSelect{table: "t", cols: []SelectItem{{expr: &ExprColumn{"a"}}}, offset: 5}
+	testParseStmt(t, s, stmt)
+
+	s = "select g, count(*) from t group by g, h having max(a) > 1;"
+	stmt = &StmtSelect{
+		table: "t",
+		cols:  []SelectItem{{expr: &ExprColumn{"g"}}, {expr: &ExprCall{name: "COUNT"}}},
+		group: []string{"g", "h"},
+		having: &ExprBinary{op: ">",
+			left: &ExprCall{name: "MAX", arg: &ExprColumn{"a"}}, right: Cell{Type: TypeI64, I64: 1},
+		},
+	}
+	testParseStmt(t, s, stmt)
+
+	s = "select distinct a from t;"
+	stmt = &StmtSelect{distinct: true, table: "t", cols: []SelectItem{{expr: &ExprColumn{"a"}}}}
+	testParseStmt(t, s, stmt)
+
 	s = "create table t (a string, b int64, primary key (b));"
 	stmt = &StmtCreatTable{
 		table: "t",
@@ -104,21 +165,30 @@ func TestParseStmt(t *testing.T) {
 	stmt = &StmtUpdate{
 		table: "t",
 		value: []NamedCell{{"a", Cell{Type: TypeI64, I64: 1}}, {"b", Cell{Type: TypeI64, I64: 2}}},
-		keys:  []NamedCell{{"c", Cell{Type: TypeI64, I64: 3}}, {"d", Cell{Type: TypeI64, I64: 4}}},
+		where: &ExprBinary{op: "AND",
+			left:  &ExprBinary{op: "=", left: &ExprColumn{"c"}, right: Cell{Type: TypeI64, I64: 3}},
+			right: &ExprBinary{op: "=", left: &ExprColumn{"d"}, right: Cell{Type: TypeI64, I64: 4}},
+		},
 	}
 	testParseStmt(t, s, stmt)
 
 	s = "delete from t where c = 3 and d = 4;"
 	stmt = &StmtDelete{
 		table: "t",
-		keys:  []NamedCell{{"c", Cell{Type: TypeI64, I64: 3}}, {"d", Cell{Type: TypeI64, I64: 4}}},
+		where: &ExprBinary{op: "AND",
+			left:  &ExprBinary{op: "=", left: &ExprColumn{"c"}, right: Cell{Type: TypeI64, I64: 3}},
+			right: &ExprBinary{op: "=", left: &ExprColumn{"d"}, right: Cell{Type: TypeI64, I64: 4}},
+		},
 	}
 	testParseStmt(t, s, stmt)
 
 	s = "delete from t where c = \"banana\" and d = 4;"
 	stmt = &StmtDelete{
 		table: "t",
-		keys:  []NamedCell{{"c", Cell{Type: TypeStr, Str: []byte("banana")}}, {"d", Cell{Type: TypeI64, I64: 4}}},
+		where: &ExprBinary{op: "AND",
+			left:  &ExprBinary{op: "=", left: &ExprColumn{"c"}, right: Cell{Type: TypeStr, Str: []byte("banana")}},
+			right: &ExprBinary{op: "=", left: &ExprColumn{"d"}, right: Cell{Type: TypeI64, I64: 4}},
+		},
 	}
 	testParseStmt(t, s, stmt)
 
@@ -133,4 +203,22 @@ func TestParseStmt(t *testing.T) {
 
 	// insert, update, delete
 
+	s = "create index by_ab on t (a, b);"
+	stmt = &StmtCreateIndex{name: "by_ab", table: "t", cols: []string{"a", "b"}}
+	testParseStmt(t, s, stmt)
+	s = "CREATE UNIQUE INDEX u ON t (a);"
+	stmt = &StmtCreateIndex{name: "u", table: "t", cols: []string{"a"}, unique: true}
+	testParseStmt(t, s, stmt)
+	s = "drop index u on t;"
+	stmt = &StmtDropIndex{name: "u", table: "t"}
+	testParseStmt(t, s, stmt)
+
+	s = "explain analyze select a from t;"
+	stmt = &StmtExplain{stmt: &StmtSelect{table: "t", cols: []SelectItem{{expr: &ExprColumn{"a"}}}}, analyze: true}
+	testParseStmt(t, s, stmt)
+
+	testParseStmt(t, "begin;", &StmtBegin{})
+	testParseStmt(t, "BEGIN TRANSACTION ;", &StmtBegin{})
+	testParseStmt(t, "commit;", &StmtCommit{})
+	testParseStmt(t, "rollback;", &StmtRollback{})
 }
@@ -0,0 +1,314 @@
+package kvdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+/*
+An SSTable is an immutable file of sorted entries, written once by a
+memtable flush or a compaction.
+
+All integer fields are encoded using Little Endian.
+
+File Format
+| data blocks ... | index entries ... | last key entry | footer |
+
+Data blocks hold log entries (see Entry.Encode), deletions included, cut
+after about sstBlockSize bytes. Each index entry is keyed by the first key
+of a block and its 8 byte value is the block offset. The footer is
+| index offset 8B | block count 8B | magic 8B |.
+*/
+const (
+	sstBlockSize  = 4096
+	sstFooterSize = 24
+)
+
+var sstMagic = []byte("TinySST1")
+
+var ErrBadTable = errors.New("corrupt SSTable")
+
+type sstable struct {
+	id      uint64
+	path    string
+	fp      *os.File
+	size    int64    // file size
+	first   [][]byte // first key of every block
+	offsets []int64  // block offsets, plus the index offset at the end
+	last    []byte
+	// refs counts the level holding the table plus the open iterators. An
+	// obsolete table is closed and deleted once the last reference goes.
+	refs     atomic.Int32
+	obsolete atomic.Bool
+}
+
+// sstWriter streams sorted entries into a new table file.
+type sstWriter struct {
+	fp    *os.File
+	w     *bufio.Writer
+	path  string
+	off   int64
+	block int64 // bytes in the current block
+	index []Entry
+	last  []byte
+}
+
+func newSSTWriter(path string) (*sstWriter, error) {
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &sstWriter{fp: fp, w: bufio.NewWriter(fp), path: path}, nil
+}
+
+func (sw *sstWriter) add(ent *Entry) error {
+	check(sw.last == nil || bytes.Compare(sw.last, ent.key) < 0)
+	if len(sw.index) == 0 || sw.block >= sstBlockSize {
+		off := binary.LittleEndian.AppendUint64(nil, uint64(sw.off))
+		sw.index = append(sw.index, Entry{key: ent.key, val: off})
+		sw.block = 0
+	}
+	data := ent.Encode()
+	if _, err := sw.w.Write(data); err != nil {
+		return err
+	}
+	sw.off += int64(len(data))
+	sw.block += int64(len(data))
+	sw.last = ent.key
+	return nil
+}
+
+// finish writes the index and footer, fsyncs the file and opens it as a
+// table. The caller makes the new file name durable (syncDir).
+func (sw *sstWriter) finish(id uint64) (*sstable, error) {
+	check(len(sw.index) > 0)
+	indexOff := sw.off
+	ents := append(sw.index, Entry{key: sw.last})
+	for i := range ents {
+		if _, err := sw.w.Write(ents[i].Encode()); err != nil {
+			return nil, sw.abort(err)
+		}
+	}
+	footer := binary.LittleEndian.AppendUint64(nil, uint64(indexOff))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(len(sw.index)))
+	footer = append(footer, sstMagic...)
+	if _, err := sw.w.Write(footer); err != nil {
+		return nil, sw.abort(err)
+	}
+	if err := sw.w.Flush(); err != nil {
+		return nil, sw.abort(err)
+	}
+	if err := sw.fp.Sync(); err != nil {
+		return nil, sw.abort(err)
+	}
+	if err := sw.fp.Close(); err != nil {
+		return nil, sw.abort(err)
+	}
+	return openSST(sw.path, id)
+}
+
+// abort drops the partially written file.
+func (sw *sstWriter) abort(err error) error {
+	_ = sw.fp.Close()
+	_ = os.Remove(sw.path)
+	return err
+}
+
+// openSST reads the footer and index of a table; blocks are read on demand.
+func openSST(path string, id uint64) (*sstable, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &sstable{id: id, path: path, fp: fp}
+	if err = t.load(); err != nil {
+		_ = fp.Close()
+		return nil, err
+	}
+	t.refs.Store(1)
+	return t, nil
+}
+
+func (t *sstable) load() error {
+	st, err := t.fp.Stat()
+	if err != nil {
+		return err
+	}
+	t.size = st.Size()
+	if t.size < sstFooterSize {
+		return ErrBadTable
+	}
+	footer := make([]byte, sstFooterSize)
+	if _, err := t.fp.ReadAt(footer, t.size-sstFooterSize); err != nil {
+		return err
+	}
+	indexOff := int64(binary.LittleEndian.Uint64(footer[0:8]))
+	nblocks := binary.LittleEndian.Uint64(footer[8:16])
+	if !bytes.Equal(footer[16:], sstMagic) || indexOff > t.size-sstFooterSize {
+		return ErrBadTable
+	}
+
+	data := make([]byte, t.size-sstFooterSize-indexOff)
+	if _, err := t.fp.ReadAt(data, indexOff); err != nil {
+		return err
+	}
+	r := bytes.NewReader(data)
+	for i := uint64(0); i <= nblocks; i++ {
+		ent := Entry{}
+		if err := ent.Decode(r); err != nil {
+			return ErrBadTable
+		}
+		if i == nblocks {
+			t.last = ent.key
+			break
+		}
+		if len(ent.val) != lengthSize {
+			return ErrBadTable
+		}
+		t.first = append(t.first, ent.key)
+		t.offsets = append(t.offsets, int64(binary.LittleEndian.Uint64(ent.val)))
+	}
+	if nblocks == 0 {
+		return ErrBadTable
+	}
+	t.offsets = append(t.offsets, indexOff)
+	return nil
+}
+
+func (t *sstable) ref() { t.refs.Add(1) }
+
+func (t *sstable) unref() {
+	if t.refs.Add(-1) == 0 {
+		_ = t.fp.Close()
+		if t.obsolete.Load() {
+			_ = os.Remove(t.path)
+		}
+	}
+}
+
+// overlaps reports whether the table may hold keys in [lo, hi].
+func (t *sstable) overlaps(lo []byte, hi []byte) bool {
+	return bytes.Compare(t.first[0], hi) <= 0 && bytes.Compare(lo, t.last) <= 0
+}
+
+// block reads and decodes block i.
+func (t *sstable) block(i int) ([]Entry, error) {
+	data := make([]byte, t.offsets[i+1]-t.offsets[i])
+	if _, err := t.fp.ReadAt(data, t.offsets[i]); err != nil {
+		return nil, err
+	}
+	ents := []Entry{}
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		ent := Entry{}
+		if err := ent.Decode(r); err == io.ErrUnexpectedEOF || err == ErrBadLength {
+			return nil, ErrBadTable
+		} else if err != nil {
+			return nil, err
+		}
+		ents = append(ents, ent)
+	}
+	return ents, nil
+}
+
+// blockIndex picks the block whose range may contain key.
+func (t *sstable) blockIndex(key []byte) int {
+	idx, found := BinarySearchFunc(t.first, key, bytes.Compare)
+	if found || idx == 0 {
+		return idx
+	}
+	return idx - 1
+}
+
+// get finds the newest entry for key in the table, which may be a deletion.
+func (t *sstable) get(key []byte) (ent *Entry, err error) {
+	if !t.overlaps(key, key) {
+		return nil, nil
+	}
+	ents, err := t.block(t.blockIndex(key))
+	if err != nil {
+		return nil, err
+	}
+	idx, found := BinarySearchFunc(ents, key, func(ent Entry, key []byte) int {
+		return bytes.Compare(ent.key, key)
+	})
+	if !found {
+		return nil, nil
+	}
+	return &ents[idx], nil
+}
+
+// sstIter walks the entries of one table, deletions included.
+type sstIter struct {
+	table *sstable
+	blk   int
+	ents  []Entry
+	pos   int // -1 before the first entry, len(ents) past the last
+}
+
+// seek positions the iterator at the first key >= key.
+func (t *sstable) seek(key []byte) (*sstIter, error) {
+	iter := &sstIter{table: t, blk: t.blockIndex(key)}
+	if err := iter.loadBlock(iter.blk); err != nil {
+		return nil, err
+	}
+	iter.pos, _ = BinarySearchFunc(iter.ents, key, func(ent Entry, key []byte) int {
+		return bytes.Compare(ent.key, key)
+	})
+	if iter.pos == len(iter.ents) {
+		// the key is past this block
+		iter.pos--
+		return iter, iter.Next()
+	}
+	return iter, nil
+}
+
+func (iter *sstIter) loadBlock(i int) (err error) {
+	iter.blk = i
+	iter.ents, err = iter.table.block(i)
+	return err
+}
+
+func (iter *sstIter) Valid() bool {
+	return 0 <= iter.pos && iter.pos < len(iter.ents)
+}
+
+func (iter *sstIter) Key() []byte   { return iter.ents[iter.pos].key }
+func (iter *sstIter) Val() []byte   { return iter.ents[iter.pos].val }
+func (iter *sstIter) deleted() bool { return iter.ents[iter.pos].deleted }
+func (iter *sstIter) Close()        {}
+
+func (iter *sstIter) Next() error {
+	switch {
+	case iter.pos+1 < len(iter.ents):
+		iter.pos++
+	case iter.blk+1 < len(iter.table.first):
+		if err := iter.loadBlock(iter.blk + 1); err != nil {
+			return err
+		}
+		iter.pos = 0
+	default:
+		iter.pos = len(iter.ents)
+	}
+	return nil
+}
+
+func (iter *sstIter) Prev() error {
+	switch {
+	case iter.pos-1 >= 0:
+		iter.pos--
+	case iter.blk > 0:
+		if err := iter.loadBlock(iter.blk - 1); err != nil {
+			return err
+		}
+		iter.pos = len(iter.ents) - 1
+	default:
+		iter.pos = -1
+	}
+	return nil
+}
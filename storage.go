@@ -0,0 +1,49 @@
+package kvdb
+
+// Storage is the key-value store under a DB. KV is the durable one; MemKV
+// keeps everything in memory.
+type Storage interface {
+	Open() error
+	Close() error
+	Get(key []byte) (val []byte, ok bool, err error)
+	SetEx(key []byte, val []byte, mode UpdateMode) (updated bool, err error)
+	Del(key []byte) (deleted bool, err error)
+	// Seek positions an iterator at the first key >= key. The iterator
+	// does not see writes made after Seek returns.
+	Seek(key []byte) (*KVIterator, error)
+	NewBatch() *Batch
+	// Apply commits every write in the batch, in order, or none of them.
+	Apply(b *Batch) error
+	// Snapshot opens a consistent view for a transaction, see kv_snapshot.go.
+	Snapshot() Snapshot
+}
+
+// Snapshot is a read-only view of a Storage as of one point in time that
+// commits a transaction's writes. Call Release when done; the snapshot
+// keeps old data alive until then.
+type Snapshot interface {
+	Get(key []byte) (val []byte, ok bool, err error)
+	// Seek positions an iterator at the first key >= key. The iterator
+	// stays valid after Release until it is closed.
+	Seek(key []byte) (*KVIterator, error)
+	// Apply commits the batch, or fails with ErrConflict if a key in it
+	// was written after the snapshot was taken.
+	Apply(b *Batch) error
+	Release()
+}
+
+var (
+	_ Storage = (*KV)(nil)
+	_ Storage = (*MemKV)(nil)
+)
+
+// MemKV is a KV that keeps its log in memory (see MemoryFileName), so
+// nothing touches the disk and the data is gone after Close.
+type MemKV struct {
+	KV
+}
+
+func (mem *MemKV) Open() error {
+	mem.log.FileName = MemoryFileName
+	return mem.KV.Open()
+}
@@ -0,0 +1,108 @@
+package kvdb
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// MemKV must behave like the log-backed KV
+func TestMemKV(t *testing.T) {
+	os.Remove(".test_db")
+	defer os.Remove(".test_db")
+	kv := &KV{}
+	kv.log.FileName = ".test_db"
+	kv.SyncMode = SyncNone
+	stores := []Storage{kv, &MemKV{}}
+	for _, store := range stores {
+		require.Nil(t, store.Open())
+		defer store.Close()
+	}
+
+	modes := []UpdateMode{ModeUpsert, ModeInsert, ModeUpdate}
+	for i := 0; i < 2000; i++ {
+		k := []byte(fmt.Sprintf("k%03d", rand.IntN(300)))
+		v := []byte(fmt.Sprintf("v%d", rand.IntN(3)))
+		del := rand.IntN(5) == 0
+		results := []bool{}
+		for _, store := range stores {
+			var done bool
+			var err error
+			if del {
+				done, err = store.Del(k)
+			} else {
+				done, err = store.SetEx(k, v, modes[i%3])
+			}
+			require.Nil(t, err)
+			results = append(results, done)
+		}
+		require.Equal(t, results[0], results[1])
+	}
+
+	for _, store := range stores {
+		b := store.NewBatch()
+		b.Set([]byte("k000"), []byte("batch"))
+		b.Del([]byte("k001"))
+		require.Nil(t, store.Apply(b))
+	}
+
+	iters := []*KVIterator{}
+	for _, store := range stores {
+		iter, err := store.Seek([]byte("k1"))
+		require.Nil(t, err)
+		iters = append(iters, iter)
+	}
+	// iterators are snapshots in both
+	for _, store := range stores {
+		_, err := store.Del([]byte("k150"))
+		require.Nil(t, err)
+	}
+	for iters[0].Valid() {
+		require.True(t, iters[1].Valid())
+		assert.Equal(t, iters[0].Key(), iters[1].Key())
+		assert.Equal(t, iters[0].Val(), iters[1].Val())
+		iters[0].Next()
+		iters[1].Next()
+	}
+	assert.False(t, iters[1].Valid())
+
+	for i := 0; i < 300; i++ {
+		k := []byte(fmt.Sprintf("k%03d", i))
+		v0, ok0, err0 := stores[0].Get(k)
+		v1, ok1, err1 := stores[1].Get(k)
+		require.True(t, err0 == nil && err1 == nil)
+		assert.Equal(t, ok0, ok1)
+		assert.Equal(t, v0, v1)
+	}
+}
+
+func TestDBMemKV(t *testing.T) {
+	db := NewDB(&MemKV{})
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	stmts := []string{
+		"create table t (k int64, v string, primary key (k));",
+		"insert into t values (1, 'a');",
+		"insert into t values (2, 'b');",
+		"update t set v = 'c' where k = 2;",
+		"delete from t where k = 1;",
+	}
+	for _, s := range stmts {
+		_, err := db.ExecStmt(parseStmt(t, s))
+		require.Nil(t, err)
+	}
+	r, err := db.ExecStmt(parseStmt(t, "select v from t where k = 2;"))
+	require.Nil(t, err)
+	assert.Equal(t, []Row{{Cell{Type: TypeStr, Str: []byte("c")}}}, r.Values)
+	r, err = db.ExecStmt(parseStmt(t, "select v from t where k = 1;"))
+	require.True(t, err == nil && len(r.Values) == 0)
+
+	// no file is involved
+	_, err = os.Stat(".test_db")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -1,38 +1,78 @@
 package kvdb
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"maps"
+	"slices"
 	"strings"
+	"sync"
 )
 
 type DB struct {
-	KV     KV
-	tables map[string]Schema
+	KV KV
+	// Storage holds the tables. Open defaults it to the KV above.
+	Storage Storage
+	mu      sync.Mutex // guards tables
+	tables  map[string]Schema
+	// writer serializes the DB level writes so that read-modify-write
+	// statements like UPDATE are not interleaved with other writes
+	writer sync.Mutex
 }
 
 type SQLResult struct {
 	Updated int
 	Header  []string
-	Values  []Row
+	// Values holds the rows of a query. A cell without a Type is NULL,
+	// which only SUM, AVG, MIN and MAX of no values give.
+	Values []Row
 }
 
 type RowIterator struct {
-	schema *Schema
-	iter   *KVIterator
-	valid  bool
-	row    Row // decoded result
+	schema  *Schema
+	iter    *KVIterator
+	valid   bool
+	row     Row    // decoded result
+	lo, hi  []byte // the keys in [lo, hi) are in range, a nil hi is open
+	reverse bool   // Next walks down
+	// set when iterating over an index, get reads the rows
+	index *Index
+	get   func([]byte) ([]byte, bool, error)
+	snap  Snapshot // opened by the DB for the iterator, released by Close
+}
+
+// ScanRange selects rows by their leading primary key columns, or indexed
+// columns when scanning an index. A tuple
+// shorter than the primary key covers every row it is a prefix of, and an
+// empty one leaves its side of the range open.
+type ScanRange struct {
+	Start     []Cell
+	StartIncl bool
+	End       []Cell
+	EndIncl   bool
+	Reverse   bool // from End down to Start
+}
+
+// NewDB returns a DB over the given storage.
+func NewDB(store Storage) *DB {
+	return &DB{Storage: store}
 }
 
 func (db *DB) Open() error {
+	db.mu.Lock()
 	db.tables = map[string]Schema{}
-	return db.KV.Open()
+	db.mu.Unlock()
+	if db.Storage == nil {
+		db.Storage = &db.KV
+	}
+	return db.Storage.Open()
 }
-func (db *DB) Close() error { return db.KV.Close() }
+func (db *DB) Close() error { return db.Storage.Close() }
 
 func (db *DB) Select(schema *Schema, row Row) (ok bool, err error) {
 	key := row.EncodeKey(schema)
-	value, ok, err := db.KV.Get(key)
+	value, ok, err := db.Storage.Get(key)
 
 	if !ok || err != nil {
 		return ok, err
@@ -45,42 +85,126 @@ func (db *DB) Select(schema *Schema, row Row) (ok bool, err error) {
 
 }
 
+// The writes below each run in a transaction of their own.
+
 func (db *DB) Insert(schema *Schema, row Row) (updated bool, err error) {
-	key := row.EncodeKey(schema)
-	val := row.EncodeVal(schema)
-	return db.KV.SetEx(key, val, ModeInsert)
+	err = db.autocommit(func(tx *Tx) error {
+		updated, err = tx.Insert(schema, row)
+		return err
+	})
+	return updated, err
 }
 
 func (db *DB) Upsert(schema *Schema, row Row) (updated bool, err error) {
-	key := row.EncodeKey(schema)
-	val := row.EncodeVal(schema)
-	return db.KV.SetEx(key, val, ModeUpsert)
+	err = db.autocommit(func(tx *Tx) error {
+		updated, err = tx.Upsert(schema, row)
+		return err
+	})
+	return updated, err
 }
 
 func (db *DB) Update(schema *Schema, row Row) (updated bool, err error) {
-	key := row.EncodeKey(schema)
-	val := row.EncodeVal(schema)
-	return db.KV.SetEx(key, val, ModeUpdate)
+	err = db.autocommit(func(tx *Tx) error {
+		updated, err = tx.Update(schema, row)
+		return err
+	})
+	return updated, err
 }
 
 func (db *DB) Delete(schema *Schema, row Row) (deleted bool, err error) {
-	key := row.EncodeKey(schema)
-	return db.KV.Del(key)
+	err = db.autocommit(func(tx *Tx) error {
+		deleted, err = tx.Delete(schema, row)
+		return err
+	})
+	return deleted, err
 }
 
+// ExecStmt runs the statement in a transaction of its own. BEGIN, COMMIT
+// and ROLLBACK need a Session.
 func (db *DB) ExecStmt(stmt interface{}) (r SQLResult, err error) {
+	switch stmt.(type) {
+	case *StmtBegin, *StmtCommit, *StmtRollback:
+		return r, errors.New("use a Session for BEGIN, COMMIT and ROLLBACK")
+	case *StmtSelect, *StmtExplain:
+		// a read-only snapshot keeps the index and the rows consistent
+		tx := db.Begin()
+		defer tx.Rollback()
+		return tx.ExecStmt(stmt)
+	}
+	err = db.autocommit(func(tx *Tx) error {
+		r, err = tx.ExecStmt(stmt)
+		return err
+	})
+	return r, err
+}
+
+// Session runs the statements of one client. The statements between BEGIN
+// and COMMIT or ROLLBACK run in one transaction, the others each in a
+// transaction of their own. A Session is not safe for concurrent use.
+type Session struct {
+	db *DB
+	tx *Tx // opened by BEGIN
+}
+
+func (db *DB) Session() *Session {
+	return &Session{db: db}
+}
+
+func (sess *Session) ExecStmt(stmt interface{}) (r SQLResult, err error) {
+	tx := sess.tx
+	switch stmt.(type) {
+	case *StmtBegin:
+		if tx != nil {
+			return r, errors.New("a transaction is already open")
+		}
+		sess.tx = sess.db.Begin()
+		return r, nil
+	case *StmtCommit, *StmtRollback:
+		if tx == nil {
+			return r, errors.New("no transaction is open")
+		}
+		sess.tx = nil
+		if _, ok := stmt.(*StmtCommit); ok {
+			return r, tx.Commit()
+		}
+		return r, tx.Rollback()
+	}
+	if tx != nil {
+		return tx.ExecStmt(stmt)
+	}
+	return sess.db.ExecStmt(stmt)
+}
+
+// ExecStmt runs the statement in the transaction. A statement that fails
+// leaves none of its writes behind.
+func (tx *Tx) ExecStmt(stmt interface{}) (r SQLResult, err error) {
+	keys, vals, tables := tx.keys, tx.vals, maps.Clone(tx.tables)
+	tx.shared = true // the next write copies keys/vals
+	defer func() {
+		if err != nil && !tx.done {
+			tx.keys, tx.vals, tx.tables = keys, vals, tables
+		}
+	}()
 	switch ptr := stmt.(type) {
 	case *StmtCreatTable:
-		err = db.execCreateTable(ptr)
+		err = tx.execCreateTable(ptr)
+	case *StmtCreateIndex:
+		err = tx.execCreateIndex(ptr)
+	case *StmtDropIndex:
+		err = tx.execDropIndex(ptr)
 	case *StmtSelect:
-		r.Header = ptr.cols
-		r.Values, err = db.execSelect(ptr)
+		r.Header, r.Values, err = tx.execSelect(ptr)
+	case *StmtExplain:
+		r.Header = []string{"plan"}
+		r.Values, err = tx.execExplain(ptr)
 	case *StmtInsert:
-		r.Updated, err = db.execInsert(ptr)
+		r.Updated, err = tx.execInsert(ptr)
 	case *StmtUpdate:
-		r.Updated, err = db.execUpdate(ptr)
+		r.Updated, err = tx.execUpdate(ptr)
 	case *StmtDelete:
-		r.Updated, err = db.execDelete(ptr)
+		r.Updated, err = tx.execDelete(ptr)
+	case *StmtBegin, *StmtCommit, *StmtRollback:
+		err = errors.New("use Commit or Rollback to end a Tx")
 	default:
 		panic("unreachable")
 	}
@@ -107,30 +231,6 @@ func lookupColumns(cols []Column, pkeys []string) ([]int, error) {
 	return PKeyIndex, nil
 }
 
-func makePKey(schema *Schema, pkeys []NamedCell) (Row, error) {
-
-	if len(schema.PKey) != len(pkeys) {
-		return nil, errors.New("Not a primary key")
-	}
-
-	row := schema.NewRow()
-
-	for _, pkey := range(schema.PKey){
-		found := false
-		for _, cell := range(pkeys) {
-			if strings.EqualFold(schema.Cols[pkey].Name, cell.column) && schema.Cols[pkey].Type == cell.value.Type {
-				row[pkey] = cell.value
-				found = true
-			}
-		}
-		if !found {
-			return nil, errors.New("Not a primary key")
-		}
-	}
-
-	return row, nil
-} 
-
 func subsetRow(row Row, indices []int) (updated Row) {
 	for _, PKeyIndex := range(indices) {
 		updated = append(updated, row[PKeyIndex])
@@ -139,12 +239,12 @@ func subsetRow(row Row, indices []int) (updated Row) {
 	return updated 
 } 
 
-func (db *DB) execCreateTable(stmt *StmtCreatTable) (err error) {
+func (tx *Tx) execCreateTable(stmt *StmtCreatTable) (err error) {
 	if strings.EqualFold(stmt.table, ""){
 		return errors.New("Table name must not be empty")
 	}
 		
-	if _, err := db.GetSchema(stmt.table); err == nil {
+	if _, err := tx.GetSchema(stmt.table); err == nil {
 		return errors.New("Table under the name: " + stmt.table + " already exists!")
 	}
 
@@ -156,21 +256,38 @@ func (db *DB) execCreateTable(stmt *StmtCreatTable) (err error) {
 
 	info, err := json.Marshal(schema)
 	check(err == nil)
-	updated, err := db.KV.Set([]byte("@schema_" + stmt.table), info)
+	updated, err := tx.setEx([]byte("@schema_" + stmt.table), info, ModeInsert)
 
-	if !updated || err != nil {
+	if err != nil {
 		return err
 	}
+	if !updated {
+		return errors.New("Table under the name: " + stmt.table + " already exists!")
+	}
 
-	db.tables[schema.Table] = schema
+	// cached by the DB once the transaction commits
+	tx.tables[schema.Table] = schema
 
 	return nil 
 }
 
+// putSchema writes a changed schema of a table.
+func (tx *Tx) putSchema(schema Schema) error {
+	info, err := json.Marshal(schema)
+	check(err == nil)
+	if _, err = tx.setEx([]byte("@schema_"+schema.Table), info, ModeUpdate); err != nil {
+		return err
+	}
+	tx.tables[schema.Table] = schema
+	return nil
+}
+
 func (db *DB) GetSchema(table string) (Schema, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	schema, ok := db.tables[table]
 	if !ok {
-		val, ok, err := db.KV.Get([]byte("@schema_" + table))
+		val, ok, err := db.Storage.Get([]byte("@schema_" + table))
 		if err == nil && ok {
 			err = json.Unmarshal(val, &schema)
 		}
@@ -185,34 +302,87 @@ func (db *DB) GetSchema(table string) (Schema, error) {
 	return schema, nil
 }
 
-func (db *DB) execSelect(stmt *StmtSelect) ([]Row, error){
-	schema, err := db.GetSchema(stmt.table)
+func (tx *Tx) execSelect(stmt *StmtSelect) ([]string, []Row, error){
+	schema, err := tx.GetSchema(stmt.table)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	indices, err := lookupColumns(schema.Cols, stmt.cols)
+	exprs, header, err := bindColumns(&schema, stmt.cols)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if isAggregate(stmt, exprs) {
+		ap, err := planAggregate(&schema, stmt, exprs, header)
+		if err != nil {
+			return nil, nil, err
+		}
+		out := []Row{}
+		err = tx.execAggregate(&schema, ap, func(row Row) error {
+			out = append(out, row)
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return header, out, nil
 	}
 
-	row, err := makePKey(&schema, stmt.keys)
+	plan, err := planSelect(&schema, stmt, exprs, header)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	
-	if ok, err := db.Select(&schema,row); err != nil || !ok {
-		return nil, err
+	if stmt.distinct {
+		plan.setDistinct(&schema, exprs)
 	}
-	
-	row = subsetRow(row,indices)
 
-	return []Row{row}, nil
+	out := []Row{}
+	err = tx.execQuery(&schema, plan, func(row Row) error {
+		out = append(out, project(exprs, row))
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, out, nil
 }
 
-func (db *DB) execInsert(stmt *StmtInsert) (count int, err error) {
+// bindColumns resolves the SELECT list into an expression per output
+// column and the column names, which are the aliases where given.
+func bindColumns(schema *Schema, items []SelectItem) (exprs []Expr, names []string, err error) {
+	for _, item := range items {
+		if item.expr == nil {
+			for i, col := range schema.Cols {
+				exprs = append(exprs, &exprCol{col: i, name: col.Name})
+				names = append(names, col.Name)
+			}
+			continue
+		}
+		expr, _, err := bindExpr(schema, item.expr)
+		if err != nil {
+			return nil, nil, err
+		}
+		name := item.alias
+		if name == "" {
+			name = formatExpr(expr)
+		}
+		exprs = append(exprs, expr)
+		names = append(names, name)
+	}
+	return exprs, names, nil
+}
+
+func project(exprs []Expr, row Row) Row {
+	out := make(Row, len(exprs))
+	for i, expr := range exprs {
+		out[i] = evalExpr(expr, row)
+	}
+	return out
+}
+
+func (tx *Tx) execInsert(stmt *StmtInsert) (count int, err error) {
 	
-	schema, err := db.GetSchema(stmt.table)
+	schema, err := tx.GetSchema(stmt.table)
 	
 	if err != nil {
 		return 0, err
@@ -228,7 +398,7 @@ func (db *DB) execInsert(stmt *StmtInsert) (count int, err error) {
 		}
 	}
 
-	updated, err := db.Insert(&schema,stmt.value)
+	updated, err := tx.Insert(&schema,stmt.value)
 	
 	if err != nil {
 		return 0, err
@@ -240,24 +410,32 @@ func (db *DB) execInsert(stmt *StmtInsert) (count int, err error) {
 	return count, nil
 }
 
-func (db *DB) execUpdate(stmt *StmtUpdate) (count int, err error){
-	
-	schema ,err := db.GetSchema(stmt.table)
-	
+// matchRows collects the rows the WHERE clause selects.
+func (tx *Tx) matchRows(schema *Schema, where Expr) ([]Row, error) {
+	conjs, err := bindWhere(schema, where)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-
-	row, err := makePKey(&schema, stmt.keys)
+	rows := []Row{}
+	err = tx.execPlan(schema, planQuery(schema, conjs, true), func(row Row) error {
+		rows = append(rows, slices.Clone(row))
+		return nil
+	})
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	return rows, nil
+}
+
+func (tx *Tx) execUpdate(stmt *StmtUpdate) (count int, err error){
 	
-	if ok, err := db.Select(&schema,row); err != nil || !ok {
+	schema ,err := tx.GetSchema(stmt.table)
+	
+	if err != nil {
 		return 0, err
 	}
-	
 
+	updating := []int{}
 	for _, updatedValue := range(stmt.value) {
 		found := false
 		updatingIndex := 0
@@ -277,41 +455,49 @@ func (db *DB) execUpdate(stmt *StmtUpdate) (count int, err error){
 				return 0, errors.New("Updating a primary key is not allowed")
 			}
 		}
-		row[updatingIndex] = updatedValue.value
+		updating = append(updating, updatingIndex)
 	}
-	
-	updated, err := db.Update(&schema,row)
 
+	rows, err := tx.matchRows(&schema, stmt.where)
 	if err != nil {
 		return 0, err
 	}
-	if updated {
-		count += 1
+
+	for _, row := range(rows) {
+		for i, updatingIndex := range(updating) {
+			row[updatingIndex] = stmt.value[i].value
+		}
+		updated, err := tx.Update(&schema, row)
+		if err != nil {
+			return 0, err
+		}
+		if updated {
+			count += 1
+		}
 	}
 	return count, nil
 }
 
-func (db *DB) execDelete(stmt *StmtDelete) (count int, err error){
-	schema ,err := db.GetSchema(stmt.table)
+func (tx *Tx) execDelete(stmt *StmtDelete) (count int, err error){
+	schema ,err := tx.GetSchema(stmt.table)
 
 	if err != nil {
 		return 0, err
 	}
 
-	row, err := makePKey(&schema, stmt.keys)
-
-	if err != nil {
-		return 0, err 
-	}
-
-	updated, err := db.Delete(&schema,row)
-	
+	rows, err := tx.matchRows(&schema, stmt.where)
 	if err != nil {
 		return 0, err
 	}
 
-	if updated {
-		count += 1
+	for _, row := range(rows) {
+		updated, err := tx.Delete(&schema,row)
+		if err != nil {
+			return 0, err
+		}
+		if updated {
+			count += 1
+		}
 	}
 	
 	return count, nil
@@ -320,13 +506,62 @@ func (db *DB) execDelete(stmt *StmtDelete) (count int, err error){
 
 func (iter *RowIterator) Valid() bool { return iter.valid }
 
+// Close releases the data the iterator reads. It is safe to call more than
+// once.
+func (iter *RowIterator) Close() {
+	if iter.iter != nil {
+		iter.iter.Close()
+	}
+	if iter.snap != nil {
+		iter.snap.Release()
+		iter.snap = nil
+	}
+}
+
 func (iter *RowIterator) Row() Row { check(iter.valid); return iter.row }
 
-func (iter *RowIterator) Next() (err error) {
-	if err = iter.iter.Next(); err != nil {
+// Next moves to the next row in the scan direction, Prev back.
+func (iter *RowIterator) Next() error { return iter.step(!iter.reverse) }
+func (iter *RowIterator) Prev() error { return iter.step(iter.reverse) }
+
+// step moves up or down the keys, staying put once past that end of the
+// range so that a step the other way comes back.
+func (iter *RowIterator) step(up bool) (err error) {
+	if !iter.valid && iter.iter.Valid() {
+		key := iter.iter.Key()
+		if up && iter.hi != nil && bytes.Compare(key, iter.hi) >= 0 {
+			return nil
+		}
+		if !up && bytes.Compare(key, iter.lo) < 0 {
+			return nil
+		}
+	}
+	if up {
+		err = iter.iter.Next()
+	} else {
+		err = iter.iter.Prev()
+	}
+	if err != nil {
 		return err
 	}
-	iter.valid, err = decodeKVIter(iter.schema, iter.iter, iter.row)
+	return iter.load()
+}
+
+// load decodes the current row unless the KV iterator left the range.
+func (iter *RowIterator) load() (err error) {
+	iter.valid = false
+	if !iter.iter.Valid() {
+		return nil
+	}
+	key := iter.iter.Key()
+	if bytes.Compare(key, iter.lo) < 0 || (iter.hi != nil && bytes.Compare(key, iter.hi) >= 0) {
+		return nil
+	}
+	if iter.index != nil {
+		iter.valid, err = iter.loadIndex()
+	} else {
+		iter.valid, err = decodeKVIter(iter.schema, iter.iter, iter.row)
+	}
 	return err
 }
 
@@ -353,16 +588,108 @@ func decodeKVIter(schema *Schema, iter *KVIterator, row Row) (bool, error) {
 func (db *DB) Seek(schema *Schema, row Row) (*RowIterator, error){
 
 	key := row.EncodeKey(schema)
-	iter, err := db.KV.Seek(key)
+	iter, err := db.Storage.Seek(key)
 	if err != nil {
 		return nil, err 
 	}
+	return newRowIterator(schema, iter, row)
+}
 
-	isValid, err := decodeKVIter(schema, iter, row)
-	
+// SeekLE positions an iterator at the last row with a key <= the key of row.
+func (db *DB) SeekLE(schema *Schema, row Row) (*RowIterator, error) {
+	return seekLE(schema, row.EncodeKey(schema), row, db.Storage.Seek)
+}
+
+// SeekLast positions an iterator at the last row of the table.
+func (db *DB) SeekLast(schema *Schema) (*RowIterator, error) {
+	return seekLE(schema, nil, schema.NewRow(), db.Storage.Seek)
+}
+
+// newRowIterator iterates over the rows of the table from where iter is.
+func newRowIterator(schema *Schema, iter *KVIterator, row Row) (*RowIterator, error) {
+	lo := encodeKeyPrefix(schema, nil)
+	riter := &RowIterator{schema: schema, iter: iter, row: row, lo: lo, hi: prefixEnd(lo)}
+	if err := riter.load(); err != nil {
+		riter.Close()
+		return nil, err
+	}
+	return riter, nil
+}
+
+// seekLE is SeekLE; a nil key seeks to the end of the table.
+func seekLE(schema *Schema, key []byte, row Row, seek func([]byte) (*KVIterator, error)) (*RowIterator, error) {
+	if key == nil {
+		key = prefixEnd(encodeKeyPrefix(schema, nil))
+	}
+	iter, err := seek(key)
 	if err != nil {
 		return nil, err
 	}
+	if !iter.Valid() || !bytes.Equal(iter.Key(), key) {
+		if err = iter.Prev(); err != nil {
+			iter.Close()
+			return nil, err
+		}
+	}
+	return newRowIterator(schema, iter, row)
+}
+
+// Scan returns an iterator over the rows in the range, which goes invalid
+// at the end of the range.
+func (db *DB) Scan(schema *Schema, r ScanRange) (*RowIterator, error) {
+	return scanRange(schema, r, db.Storage.Seek)
+}
+
+func scanRange(schema *Schema, r ScanRange, seek func([]byte) (*KVIterator, error)) (*RowIterator, error) {
+	riter := &RowIterator{schema: schema, row: schema.NewRow()}
+	encode := func(vals []Cell) []byte { return encodeKeyPrefix(schema, vals) }
+	if err := riter.seekRange(r, encode, seek); err != nil {
+		riter.Close()
+		return nil, err
+	}
+	return riter, nil
+}
 
-	return &RowIterator{schema: schema, iter: iter, row: row, valid: isValid}, nil 
+// seekRange positions the iterator at the first row of the range, whose
+// tuples encode turns into keys.
+func (iter *RowIterator) seekRange(r ScanRange, encode func([]Cell) []byte, seek func([]byte) (*KVIterator, error)) (err error) {
+	iter.lo = encode(nil)
+	iter.hi = prefixEnd(iter.lo)
+	if len(r.Start) > 0 {
+		iter.lo = encode(r.Start)
+		if !r.StartIncl {
+			iter.lo = prefixEnd(iter.lo)
+		}
+	}
+	if len(r.End) > 0 {
+		iter.hi = encode(r.End)
+		if r.EndIncl {
+			iter.hi = prefixEnd(iter.hi)
+		}
+	}
+
+	iter.reverse = r.Reverse
+	if !r.Reverse {
+		iter.iter, err = seek(iter.lo)
+	} else if iter.iter, err = seek(iter.hi); err == nil {
+		// step back from the first key >= hi, or from past the end
+		err = iter.iter.Prev()
+	}
+	if err != nil {
+		return err
+	}
+	return iter.load()
+}
+
+// prefixEnd returns the first key after every key that starts with prefix.
+func prefixEnd(prefix []byte) []byte {
+	end := slices.Clone(prefix)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) == 0 {
+		return nil // every key is covered
+	}
+	end[len(end)-1]++
+	return end
 }
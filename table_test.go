@@ -1,7 +1,9 @@
 package kvdb
 
 import (
+	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -122,6 +124,49 @@ func TestSQLByPKey(t *testing.T) {
 	require.Equal(t, 0, len(r.Values))
 }
 
+func TestSQLAllPKey(t *testing.T) {
+	db := DB{}
+	db.KV.log.FileName = ".test_db"
+	defer os.Remove(db.KV.log.FileName)
+
+	os.Remove(db.KV.log.FileName)
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	// the rows have nothing outside of the primary key to store
+	for _, s := range []string{
+		"create table t (a int64, b string, primary key (a, b));",
+		"insert into t values (1, 'x');",
+		"insert into t values (2, 'y');",
+	} {
+		r, err := db.ExecStmt(parseStmt(t, s))
+		require.Nil(t, err)
+		if strings.HasPrefix(s, "insert") {
+			require.Equal(t, 1, r.Updated)
+		}
+	}
+	r, err := db.ExecStmt(parseStmt(t, "select count(*) from t;"))
+	require.Nil(t, err)
+	assert.Equal(t, []Row{{Cell{Type: TypeI64, I64: 2}}}, r.Values)
+
+	schema, err := db.GetSchema("t")
+	require.Nil(t, err)
+	row := Row{{Type: TypeI64, I64: 1}, {Type: TypeStr, Str: []byte("x")}}
+	ok, err := db.Select(&schema, row)
+	assert.True(t, ok && err == nil)
+
+	// and they survive a reopen
+	require.Nil(t, db.Close())
+	db = DB{}
+	db.KV.log.FileName = ".test_db"
+	require.Nil(t, db.Open())
+	r, err = db.ExecStmt(parseStmt(t, "select a, b from t where a = 2;"))
+	require.Nil(t, err)
+	assert.Equal(t, []Row{{Cell{Type: TypeI64, I64: 2}, Cell{Type: TypeStr, Str: []byte("y")}}}, r.Values)
+	r, err = db.ExecStmt(parseStmt(t, "delete from t where b = 'x';"))
+	require.True(t, err == nil && r.Updated == 1)
+}
+
 func TestIterByPKey(t *testing.T) {
 	db := DB{}
 	db.KV.log.FileName = ".test_db"
@@ -172,4 +217,255 @@ func TestIterByPKey(t *testing.T) {
 		}
 		assert.Equal(t, expected, out)
 	}
-}
\ No newline at end of file
+}
+func TestSQLScan(t *testing.T) {
+	db := NewDB(&MemKV{})
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	exec := func(s string) (SQLResult, error) {
+		return db.ExecStmt(parseStmt(t, s))
+	}
+	_, err := exec("create table t (a int64, b int64, v string, primary key (a, b));")
+	require.Nil(t, err)
+	_, err = exec("create table u (a int64, v string, primary key (a));")
+	require.Nil(t, err)
+	for a := 0; a < 3; a++ {
+		for b := 0; b < 4; b++ {
+			_, err = exec(fmt.Sprintf("insert into t values (%d, %d, 'x%d');", a, b, b%2))
+			require.Nil(t, err)
+		}
+	}
+	// rows of the next table must not show up
+	_, err = exec("insert into u values (0, 'y');")
+	require.Nil(t, err)
+
+	query := func(s string) []string {
+		r, err := exec(s)
+		require.Nil(t, err)
+		got := []string{}
+		for _, row := range r.Values {
+			got = append(got, fmt.Sprintf("%d%d", row[0].I64, row[1].I64))
+		}
+		return got
+	}
+	assert.Len(t, query("select a, b from t;"), 12)
+	assert.Equal(t, []string{"10", "11", "12", "13"}, query("select a, b from t where a = 1;"))
+	assert.Equal(t, []string{"11", "12"}, query("select a, b from t where a = 1 and b > 0 and b <= 2;"))
+	assert.Equal(t, []string{"20", "21", "22", "23"}, query("select a, b from t where a >= 2;"))
+	assert.Equal(t, []string{"01", "11"}, query("select a, b from t where b = 1 and a > -1 and a <= 1;"))
+	assert.Equal(t, []string{"01", "03", "11", "13"}, query("select a, b from t where v = 'x1' and a < 2;"))
+	assert.Equal(t, []string{"12"}, query("select a, b from t where a = 1 and b = 2;"))
+	assert.Empty(t, query("select a, b from t where a = 1 and b > 3;"))
+
+	_, err = exec("select a from t where v > 1;")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, []string{"12", "11"}, query("select a, b from t where a = 1 and b > 0 and b <= 2 order by a desc, b desc;"))
+	assert.Equal(t, []string{"03", "02", "01", "00"}, query("select a, b from t where a < 1 order by a desc;"))
+	assert.Equal(t, []string{"00", "10", "20", "01", "11", "21"}, query("select a, b from t where b < 2 order by b;"))
+	assert.Equal(t, []string{"13", "12", "11", "10", "23", "22", "21", "20"}, query("select a, b from t where a > 0 order by a, b desc;"))
+	assert.Equal(t, []string{"21", "23", "11", "13", "20", "22", "10", "12"}, query("select a, b from t where a > 0 order by v desc, a desc, b;"))
+	_, err = exec("select a from t order by nope;")
+	assert.EqualError(t, err, "ORDER BY nope is not a column or an output name")
+
+	// the aliases come before the table columns
+	assert.Equal(t, []string{"20", "21", "22", "23", "10", "11", "12", "13"}, query("select a as x, b from t where a > 0 order by x desc, b;"))
+	assert.Equal(t, []string{"31", "21", "11", "01"}, query("select b as a, a as b from t where a = 1 order by a desc;"))
+	_, err = exec("select a = 1 as f from t order by f;")
+	assert.EqualError(t, err, "ORDER BY f can only sort on a column")
+
+	// LIMIT and OFFSET page through either order
+	assert.Equal(t, []string{"02", "03", "10"}, query("select a, b from t limit 3 offset 2;"))
+	assert.Equal(t, []string{"23", "22"}, query("select a, b from t order by a desc, b desc limit 2;"))
+	assert.Equal(t, []string{"01", "11"}, query("select a, b from t order by b, a limit 2 offset 3;"))
+	assert.Equal(t, []string{"22", "23"}, query("select a, b from t offset 10;"))
+	assert.Empty(t, query("select a, b from t limit 0;"))
+	assert.Empty(t, query("select a, b from t order by b offset 12;"))
+
+	// a sort larger than its buffer spills to a temp file
+	defer func(size int) { sortBufferSize = size }(sortBufferSize)
+	sortBufferSize = 100
+	assert.Equal(t, []string{"23", "13", "03", "22", "12"}, query("select a, b from t order by b desc, a desc limit 5;"))
+}
+
+func TestScanRange(t *testing.T) {
+	for _, engine := range []Engine{EngineLog, EngineBTree, EngineLSM} {
+		removeLSM()
+		db := DB{}
+		db.KV.Engine = engine
+		db.KV.MemtableSize = 512
+		db.KV.log.FileName = ".test_db"
+		require.Nil(t, db.Open())
+		testScanRange(t, &db)
+		require.Nil(t, db.Close())
+	}
+	removeLSM()
+}
+
+func testScanRange(t *testing.T, db *DB) {
+	schema := &Schema{
+		Table: "t",
+		Cols:  []Column{{Name: "a", Type: TypeI64}, {Name: "b", Type: TypeStr}, {Name: "v", Type: TypeI64}},
+		PKey:  []int{0, 1},
+	}
+	other := &Schema{Table: "u", Cols: schema.Cols, PKey: schema.PKey}
+	row := func(a int64, b string) Row {
+		return Row{{Type: TypeI64, I64: a}, {Type: TypeStr, Str: []byte(b)}, {Type: TypeI64, I64: 0}}
+	}
+	for a := int64(0); a < 4; a++ {
+		for _, b := range []string{"x", "y", "z"} {
+			_, err := db.Insert(schema, row(a, b))
+			require.Nil(t, err)
+			_, err = db.Insert(other, row(a, b))
+			require.Nil(t, err)
+		}
+	}
+
+	i64 := func(v int64) Cell { return Cell{Type: TypeI64, I64: v} }
+	str := func(v string) Cell { return Cell{Type: TypeStr, Str: []byte(v)} }
+	scan := func(r ScanRange) []string {
+		got := []string{}
+		iter, err := db.Scan(schema, r)
+		for ; err == nil && iter.Valid(); err = iter.Next() {
+			got = append(got, fmt.Sprintf("%d%s", iter.Row()[0].I64, iter.Row()[1].Str))
+		}
+		require.Nil(t, err)
+		return got
+	}
+
+	assert.Len(t, scan(ScanRange{}), 12)
+	assert.Len(t, scan(ScanRange{Reverse: true}), 12)
+	assert.Equal(t, []string{"1x", "1y", "1z", "2x", "2y", "2z"},
+		scan(ScanRange{Start: []Cell{i64(1)}, StartIncl: true, End: []Cell{i64(2)}, EndIncl: true}))
+	assert.Equal(t, []string{"2z", "2y", "2x", "1z", "1y", "1x"},
+		scan(ScanRange{Start: []Cell{i64(1)}, StartIncl: true, End: []Cell{i64(2)}, EndIncl: true, Reverse: true}))
+	assert.Equal(t, []string{"1z", "2x"},
+		scan(ScanRange{Start: []Cell{i64(1), str("y")}, End: []Cell{i64(2), str("y")}}))
+	assert.Equal(t, []string{"2x", "1z"},
+		scan(ScanRange{Start: []Cell{i64(1), str("y")}, End: []Cell{i64(2), str("y")}, Reverse: true}))
+	assert.Equal(t, []string{"3x", "3y", "3z"}, scan(ScanRange{Start: []Cell{i64(2)}}))
+	assert.Equal(t, []string{"0z", "0y", "0x"}, scan(ScanRange{End: []Cell{i64(1)}, Reverse: true}))
+	assert.Empty(t, scan(ScanRange{Start: []Cell{i64(3)}, End: []Cell{i64(3)}}))
+	assert.Empty(t, scan(ScanRange{Start: []Cell{i64(9)}, StartIncl: true, Reverse: true}))
+}
+
+func TestSeekLE(t *testing.T) {
+	db := NewDB(&MemKV{})
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	schema := &Schema{
+		Table: "t",
+		Cols:  []Column{{Name: "k", Type: TypeI64}, {Name: "v", Type: TypeI64}},
+		PKey:  []int{0},
+	}
+	row := func(k int64) Row { return Row{{Type: TypeI64, I64: k}, {Type: TypeI64, I64: k}} }
+	for k := int64(0); k < 10; k += 2 {
+		_, err := db.Insert(schema, row(k))
+		require.Nil(t, err)
+	}
+	_, err := db.Insert(&Schema{Table: "u", Cols: schema.Cols, PKey: schema.PKey}, row(100))
+	require.Nil(t, err)
+
+	down := func(iter *RowIterator, err error) []int64 {
+		got := []int64{}
+		for ; err == nil && iter.Valid(); err = iter.Prev() {
+			got = append(got, iter.Row()[1].I64)
+		}
+		require.Nil(t, err)
+		return got
+	}
+	assert.Equal(t, []int64{8, 6, 4, 2, 0}, down(db.SeekLast(schema)))
+	assert.Equal(t, []int64{4, 2, 0}, down(db.SeekLE(schema, row(4))))
+	assert.Equal(t, []int64{4, 2, 0}, down(db.SeekLE(schema, row(5))))
+	assert.Empty(t, down(db.SeekLE(schema, row(-1))))
+
+	// walking off an end and back
+	iter, err := db.Seek(schema, row(7))
+	require.True(t, err == nil && iter.Valid() && iter.Row()[1].I64 == 8)
+	require.Nil(t, iter.Next())
+	require.Nil(t, iter.Next())
+	assert.False(t, iter.Valid())
+	require.Nil(t, iter.Prev())
+	assert.True(t, iter.Valid() && iter.Row()[1].I64 == 8)
+	require.Nil(t, iter.Prev())
+	assert.True(t, iter.Valid() && iter.Row()[1].I64 == 6)
+}
+
+func TestSQLSelectList(t *testing.T) {
+	db := NewDB(&MemKV{})
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	exec := func(s string) (SQLResult, error) {
+		return db.ExecStmt(parseStmt(t, s))
+	}
+	_, err := exec("create table t (a int64, v string, primary key (a));")
+	require.Nil(t, err)
+	_, err = exec("insert into t values (1, 'x');")
+	require.Nil(t, err)
+
+	r, err := exec("select * from t;")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a", "v"}, r.Header)
+	assert.Equal(t, []Row{{{Type: TypeI64, I64: 1}, {Type: TypeStr, Str: []byte("x")}}}, r.Values)
+
+	r, err = exec("select v AS name, t.*, A, a = 1 as one, v like 'y%' from t;")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"name", "a", "v", "a", "one", "v LIKE 'y%'"}, r.Header)
+	assert.Equal(t, []Row{{
+		{Type: TypeStr, Str: []byte("x")}, {Type: TypeI64, I64: 1}, {Type: TypeStr, Str: []byte("x")},
+		{Type: TypeI64, I64: 1}, {Type: TypeI64, I64: 1}, {Type: TypeI64, I64: 0},
+	}}, r.Values)
+
+	_, err = exec("select nope from t;")
+	assert.NotNil(t, err)
+	for _, s := range []string{"select u.* from t;", "select a as from t;", "select t. from t;", "select",
+		"select a from t limit -1;", "select a from t limit 'x';", "select a from t offset 1 limit 1;"} {
+		p := NewParser(s)
+		_, err = p.parseStmt()
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestSQLDistinct(t *testing.T) {
+	db := NewDB(&MemKV{})
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	exec := func(s string) SQLResult {
+		r, err := db.ExecStmt(parseStmt(t, s))
+		require.Nil(t, err, s)
+		return r
+	}
+	query := func(s string) []string {
+		got := []string{}
+		for _, row := range exec(s).Values {
+			cells := []string{}
+			for i := range row {
+				cells = append(cells, formatCell(&row[i]))
+			}
+			got = append(got, strings.Join(cells, " "))
+		}
+		return got
+	}
+	exec("create table t (a int64, b int64, v string, primary key (a, b));")
+	for a := 0; a < 3; a++ {
+		for b := 0; b < 4; b++ {
+			exec(fmt.Sprintf("insert into t values (%d, %d, 'x%d');", a, b, b%2))
+		}
+	}
+
+	assert.Equal(t, []string{"0", "1", "2"}, query("select distinct a from t;"))
+	assert.Equal(t, []string{"'x0'", "'x1'"}, query("select distinct v from t;"))
+	assert.Equal(t, []string{"1 'x1'", "2 'x1'", "1 'x0'", "2 'x0'"}, query("select distinct a, v from t where a > 0 order by v desc;"))
+	assert.Len(t, query("select distinct b, a, b from t;"), 12)
+	assert.Equal(t, []string{"1", "2"}, query("select distinct a from t limit 2 offset 1;"))
+	assert.Equal(t, []string{"0 0", "1 0"}, query("select distinct v = 'x1', a > 5 from t;"))
+	assert.Equal(t, []string{"4"}, query("select distinct count(*) from t group by a;"))
+
+	// the type is part of the key
+	assert.NotEqual(t, distinctKey(Row{{Type: TypeI64, I64: 0}}), distinctKey(Row{{Type: TypeStr, Str: make([]byte, 8)}}))
+	assert.NotEqual(t, distinctKey(Row{{}}), distinctKey(Row{{Type: TypeStr}}))
+}
@@ -0,0 +1,271 @@
+package kvdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"slices"
+)
+
+// Tx buffers writes until Commit applies them to the storage as one batch.
+// Its reads see a snapshot of the data taken by Begin overlaid with its own
+// writes (snapshot isolation). A Tx is not safe for concurrent use.
+type Tx struct {
+	db   *DB
+	snap Snapshot // nil when autocommit holds db.writer throughout
+	// the write set in key order; a nil value marks a deletion
+	keys   [][]byte
+	vals   [][]byte
+	shared bool              // iterators may be reading keys/vals, see KV.shared
+	tables map[string]Schema // created or changed by this transaction
+	// the schemas the transaction read, which must not change under its
+	// writes, say by CREATE INDEX
+	used map[string]Schema
+	done bool
+}
+
+var ErrTxDone = errors.New("transaction is already committed or rolled back")
+
+// Begin starts a transaction. It holds no locks; Commit fails with
+// ErrConflict if a transaction that committed after Begin wrote one of the
+// same keys.
+func (db *DB) Begin() *Tx {
+	return db.newTx(db.Storage.Snapshot())
+}
+
+func (db *DB) newTx(snap Snapshot) *Tx {
+	return &Tx{db: db, snap: snap, tables: map[string]Schema{}, used: map[string]Schema{}}
+}
+
+// Commit applies every write of the transaction atomically.
+func (tx *Tx) Commit() error {
+	tx.db.writer.Lock()
+	defer tx.db.writer.Unlock()
+	return tx.commit()
+}
+
+// commit is Commit for a caller that holds db.writer.
+func (tx *Tx) commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	if tx.snap != nil {
+		defer tx.snap.Release()
+	}
+	if len(tx.keys) > 0 {
+		for name, schema := range tx.used {
+			cur, err := tx.db.GetSchema(name)
+			if err == nil && !reflect.DeepEqual(cur, schema) {
+				return ErrConflict
+			}
+		}
+	}
+	batch := tx.db.Storage.NewBatch()
+	for i, key := range tx.keys {
+		if tx.vals[i] == nil {
+			batch.Del(key)
+		} else {
+			batch.Set(key, tx.vals[i])
+		}
+	}
+	var err error
+	if tx.snap != nil {
+		err = tx.snap.Apply(batch)
+	} else {
+		err = tx.db.Storage.Apply(batch)
+	}
+	if err != nil {
+		return err
+	}
+	tx.db.mu.Lock()
+	for name, schema := range tx.tables {
+		tx.db.tables[name] = schema
+	}
+	tx.db.mu.Unlock()
+	return nil
+}
+
+// Rollback discards the writes of the transaction.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	if tx.snap != nil {
+		tx.snap.Release()
+	}
+	tx.keys, tx.vals, tx.tables = nil, nil, nil
+	return nil
+}
+
+// autocommit runs fn in a transaction holding db.writer, so that its reads
+// and writes are not interleaved with other writers, and commits it.
+func (db *DB) autocommit(fn func(tx *Tx) error) error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	// no other writer can commit, so the latest data is as good as a snapshot
+	tx := db.newTx(nil)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+func (tx *Tx) get(key []byte) (val []byte, ok bool, err error) {
+	if tx.done {
+		return nil, false, ErrTxDone
+	}
+	if idx, found := BinarySearchFunc(tx.keys, key, bytes.Compare); found {
+		return tx.vals[idx], tx.vals[idx] != nil, nil
+	}
+	if tx.snap != nil {
+		return tx.snap.Get(key)
+	}
+	return tx.db.Storage.Get(key)
+}
+
+func (tx *Tx) setEx(key []byte, val []byte, mode UpdateMode) (updated bool, err error) {
+	old, existed, err := tx.get(key)
+	if err != nil || !mode.updating(old, existed, val) {
+		return false, err
+	}
+	if val == nil {
+		val = []byte{}
+	}
+	tx.write(key, val)
+	return true, nil
+}
+
+func (tx *Tx) write(key []byte, val []byte) {
+	if tx.shared {
+		tx.keys, tx.vals = slices.Clone(tx.keys), slices.Clone(tx.vals)
+		tx.shared = false
+	}
+	idx, found := BinarySearchFunc(tx.keys, key, bytes.Compare)
+	if found {
+		tx.vals[idx] = val
+	} else {
+		tx.keys = slices.Insert(tx.keys, idx, key)
+		tx.vals = slices.Insert(tx.vals, idx, val)
+	}
+}
+
+// liveIter adapts a storage iterator, which has no deletions, to rawIter.
+type liveIter struct{ *KVIterator }
+
+func (liveIter) deleted() bool { return false }
+
+// seek merges the write set over a storage iterator.
+func (tx *Tx) seek(key []byte) (*KVIterator, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	var base *KVIterator
+	var err error
+	if tx.snap != nil {
+		base, err = tx.snap.Seek(key)
+	} else {
+		base, err = tx.db.Storage.Seek(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(tx.keys) == 0 {
+		return base, nil
+	}
+	tx.shared = true
+	idx, _ := BinarySearchFunc(tx.keys, key, bytes.Compare)
+	writes := &memIter{keys: tx.keys, vals: tx.vals, pos: idx}
+	merged, err := newMergeIter([]rawIter{writes, liveIter{base}}, false)
+	if err != nil {
+		base.Close()
+		return nil, err
+	}
+	return &KVIterator{cur: merged}, nil
+}
+
+// GetSchema returns the schema as of the snapshot, so that the queries do
+// not plan with an index whose entries the snapshot does not have.
+func (tx *Tx) GetSchema(table string) (Schema, error) {
+	if tx.done {
+		return Schema{}, ErrTxDone
+	}
+	if schema, ok := tx.tables[table]; ok {
+		return schema, nil
+	}
+	if schema, ok := tx.used[table]; ok {
+		return schema, nil
+	}
+	if tx.snap == nil {
+		// autocommit holds db.writer, the latest schema is the one
+		schema, err := tx.db.GetSchema(table)
+		if err == nil {
+			tx.used[table] = schema
+		}
+		return schema, err
+	}
+	schema := Schema{}
+	val, ok, err := tx.get([]byte("@schema_" + table))
+	if err == nil && ok {
+		err = json.Unmarshal(val, &schema)
+	}
+	if err != nil {
+		return Schema{}, err
+	}
+	if !ok {
+		return Schema{}, errors.New("table is not found")
+	}
+	tx.used[table] = schema
+	return schema, nil
+}
+
+func (tx *Tx) Select(schema *Schema, row Row) (ok bool, err error) {
+	val, ok, err := tx.get(row.EncodeKey(schema))
+	if !ok || err != nil {
+		return ok, err
+	}
+	if err = row.DecodeVal(schema, val); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// The writes below keep the indexes of the table in step, see index.go.
+
+func (tx *Tx) Insert(schema *Schema, row Row) (updated bool, err error) {
+	return tx.setRow(schema, row, ModeInsert)
+}
+
+func (tx *Tx) Upsert(schema *Schema, row Row) (updated bool, err error) {
+	return tx.setRow(schema, row, ModeUpsert)
+}
+
+func (tx *Tx) Update(schema *Schema, row Row) (updated bool, err error) {
+	return tx.setRow(schema, row, ModeUpdate)
+}
+
+func (tx *Tx) Delete(schema *Schema, row Row) (deleted bool, err error) {
+	return tx.delRow(schema, row)
+}
+
+func (tx *Tx) Seek(schema *Schema, row Row) (*RowIterator, error) {
+	iter, err := tx.seek(row.EncodeKey(schema))
+	if err != nil {
+		return nil, err
+	}
+	return newRowIterator(schema, iter, row)
+}
+
+func (tx *Tx) SeekLE(schema *Schema, row Row) (*RowIterator, error) {
+	return seekLE(schema, row.EncodeKey(schema), row, tx.seek)
+}
+
+func (tx *Tx) SeekLast(schema *Schema) (*RowIterator, error) {
+	return seekLE(schema, nil, schema.NewRow(), tx.seek)
+}
+
+func (tx *Tx) Scan(schema *Schema, r ScanRange) (*RowIterator, error) {
+	return scanRange(schema, r, tx.seek)
+}
@@ -0,0 +1,220 @@
+package kvdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTx(t *testing.T) {
+	db := NewDB(&MemKV{})
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	schema := &Schema{
+		Table: "t",
+		Cols:  []Column{{Name: "k", Type: TypeI64}, {Name: "v", Type: TypeStr}},
+		PKey:  []int{0},
+	}
+	row := func(k int64, v string) Row {
+		return Row{{Type: TypeI64, I64: k}, {Type: TypeStr, Str: []byte(v)}}
+	}
+	for _, k := range []int64{1, 3, 5} {
+		_, err := db.Insert(schema, row(k, "old"))
+		require.Nil(t, err)
+	}
+
+	tx := db.Begin()
+	updated, err := tx.Insert(schema, row(2, "new"))
+	assert.True(t, updated && err == nil)
+	updated, err = tx.Insert(schema, row(3, "dup"))
+	assert.True(t, !updated && err == nil)
+	updated, err = tx.Update(schema, row(3, "new"))
+	assert.True(t, updated && err == nil)
+	deleted, err := tx.Delete(schema, row(5, ""))
+	assert.True(t, deleted && err == nil)
+
+	// the transaction reads its own writes, nobody else does yet
+	out := row(3, "")
+	ok, err := tx.Select(schema, out)
+	assert.True(t, ok && err == nil && string(out[1].Str) == "new")
+	ok, err = db.Select(schema, out)
+	assert.True(t, ok && err == nil && string(out[1].Str) == "old")
+	ok, err = db.Select(schema, row(2, ""))
+	assert.True(t, !ok && err == nil)
+
+	scan := func(iter *RowIterator, err error) []string {
+		require.Nil(t, err)
+		got := []string{}
+		for ; err == nil && iter.Valid(); err = iter.Next() {
+			got = append(got, string(iter.Row()[1].Str))
+		}
+		require.Nil(t, err)
+		return got
+	}
+	assert.Equal(t, []string{"old", "new", "new"}, scan(tx.Seek(schema, row(0, ""))))
+	assert.Equal(t, []string{"old", "old", "old"}, scan(db.Seek(schema, row(0, ""))))
+
+	require.Nil(t, tx.Commit())
+	assert.Equal(t, []string{"old", "new", "new"}, scan(db.Seek(schema, row(0, ""))))
+	assert.Equal(t, ErrTxDone, tx.Commit())
+	_, err = tx.Insert(schema, row(9, ""))
+	assert.Equal(t, ErrTxDone, err)
+
+	tx = db.Begin()
+	_, err = tx.Delete(schema, row(1, ""))
+	require.Nil(t, err)
+	require.Nil(t, tx.Rollback())
+	ok, err = db.Select(schema, row(1, ""))
+	assert.True(t, ok && err == nil)
+}
+
+func TestTxConflict(t *testing.T) {
+	db := NewDB(&MemKV{})
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	schema := &Schema{
+		Table: "t",
+		Cols:  []Column{{Name: "k", Type: TypeI64}, {Name: "v", Type: TypeI64}},
+		PKey:  []int{0},
+	}
+	row := func(k, v int64) Row {
+		return Row{{Type: TypeI64, I64: k}, {Type: TypeI64, I64: v}}
+	}
+	for k := int64(1); k <= 2; k++ {
+		_, err := db.Insert(schema, row(k, 0))
+		require.Nil(t, err)
+	}
+
+	tx1, tx2, tx3 := db.Begin(), db.Begin(), db.Begin()
+	_, err := tx1.Update(schema, row(1, 1))
+	require.Nil(t, err)
+	_, err = tx2.Update(schema, row(1, 2))
+	require.Nil(t, err)
+	_, err = tx3.Update(schema, row(2, 3))
+	require.Nil(t, err)
+
+	require.Nil(t, tx1.Commit())
+	// tx3 still reads the data as of Begin
+	out := row(1, 0)
+	ok, err := tx3.Select(schema, out)
+	assert.True(t, ok && err == nil && out[1].I64 == 0)
+	assert.Equal(t, ErrConflict, tx2.Commit())
+	assert.Nil(t, tx3.Commit())
+
+	out = row(1, 0)
+	ok, err = db.Select(schema, out)
+	assert.True(t, ok && err == nil && out[1].I64 == 1)
+}
+
+func TestSQLTransaction(t *testing.T) {
+	db := DB{}
+	db.KV.log.FileName = ".test_db"
+	defer os.Remove(db.KV.log.FileName)
+
+	os.Remove(db.KV.log.FileName)
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	sess := db.Session()
+	exec := func(s string) (SQLResult, error) {
+		return sess.ExecStmt(parseStmt(t, s))
+	}
+	count := func() int {
+		r, err := exec("select v from t where k = 1;")
+		require.Nil(t, err)
+		return len(r.Values)
+	}
+
+	_, err := exec("commit;")
+	assert.NotNil(t, err)
+	_, err = db.ExecStmt(parseStmt(t, "begin;"))
+	assert.NotNil(t, err)
+
+	// DDL is transactional too
+	for _, s := range []string{"begin;", "create table t (k int64, v int64, primary key (k));", "rollback;"} {
+		_, err = exec(s)
+		require.Nil(t, err)
+	}
+	_, err = exec("insert into t values (1, 1);")
+	assert.NotNil(t, err)
+
+	for _, s := range []string{"begin;", "create table t (k int64, v int64, primary key (k));", "insert into t values (1, 1);"} {
+		_, err = exec(s)
+		require.Nil(t, err)
+	}
+	_, err = exec("begin;")
+	assert.NotNil(t, err)
+	// other sessions do not see the open transaction
+	_, err = db.Session().ExecStmt(parseStmt(t, "select v from t where k = 1;"))
+	assert.NotNil(t, err)
+	r, err := exec("update t set v = 2 where k = 1;")
+	require.True(t, err == nil && r.Updated == 1)
+	r, err = exec("select v from t where k = 1;")
+	require.Nil(t, err)
+	assert.Equal(t, []Row{{Cell{Type: TypeI64, I64: 2}}}, r.Values)
+	_, err = exec("commit;")
+	require.Nil(t, err)
+
+	for _, s := range []string{"begin;", "delete from t where k = 1;"} {
+		_, err = exec(s)
+		require.Nil(t, err)
+	}
+	assert.Equal(t, 0, count())
+	_, err = exec("rollback;")
+	require.Nil(t, err)
+	assert.Equal(t, 1, count())
+
+	// committed work survives a reopen
+	require.Nil(t, db.Close())
+	db = DB{}
+	db.KV.log.FileName = ".test_db"
+	require.Nil(t, db.Open())
+	sess = db.Session()
+	r, err = exec("select v from t where k = 1;")
+	require.Nil(t, err)
+	assert.Equal(t, []Row{{Cell{Type: TypeI64, I64: 2}}}, r.Values)
+}
+
+func TestSQLStatementAtomic(t *testing.T) {
+	db := NewDB(&MemKV{})
+	require.Nil(t, db.Open())
+	defer db.Close()
+
+	sess := db.Session()
+	exec := func(s string) (SQLResult, error) {
+		return sess.ExecStmt(parseStmt(t, s))
+	}
+	for _, s := range []string{
+		"create table t (id int64, v int64, primary key (id));",
+		"create unique index by_v on t (v);",
+		"insert into t values (1, 1);",
+		"insert into t values (2, 2);",
+		"begin;",
+		"insert into t values (3, 3);",
+	} {
+		_, err := exec(s)
+		require.Nil(t, err)
+	}
+	// id 1 takes v = 5, then id 2 fails on it
+	_, err := exec("update t set v = 5 where id < 3;")
+	assert.Equal(t, ErrDuplicate, err)
+	_, err = exec("create index by_nope on t (nope);")
+	assert.NotNil(t, err)
+	_, err = exec("commit;")
+	require.Nil(t, err)
+
+	r, err := exec("select id, v from t;")
+	require.Nil(t, err)
+	assert.Equal(t, []Row{
+		{Cell{Type: TypeI64, I64: 1}, Cell{Type: TypeI64, I64: 1}},
+		{Cell{Type: TypeI64, I64: 2}, Cell{Type: TypeI64, I64: 2}},
+		{Cell{Type: TypeI64, I64: 3}, Cell{Type: TypeI64, I64: 3}},
+	}, r.Values)
+	r, err = exec("select id from t where v = 5;")
+	require.Nil(t, err)
+	assert.Empty(t, r.Values)
+}